@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errNotFound = errors.New("not found")
+
+type discordAttachment struct {
+	Filename string `json:"filename"`
+	Size     int    `json:"size"`
+	URL      string `json:"url"`
+}
+
+type discordMessageReference struct {
+	MessageID string `json:"message_id"`
+	ChannelID string `json:"channel_id"`
+}
+
+type discordMessage struct {
+	ID          string                  `json:"id"`
+	ChannelID   string                  `json:"channel_id"`
+	Content     string                  `json:"content"`
+	Attachments []discordAttachment     `json:"attachments"`
+	Reference   discordMessageReference `json:"message_reference"`
+}
+
+type messageCreate struct {
+	ChannelID   string
+	ReferenceID string
+	Content     string
+	Data        []byte
+	FileName    string
+}
+
+// Backend is the storage the send and fetch logic talks to. Messages, attachments and channels
+// follow Discord's shapes so that every backend can be used interchangeably.
+type Backend interface {
+	Init() error
+	ManifestChannel() string
+	DataChannels() []string
+	PutChunk(message messageCreate) (string, error)
+	GetChunk(attachment discordAttachment) ([]byte, error)
+	GetMessage(channelID string, messageID string) (*discordMessage, error)
+	PutManifest(message messageCreate) (string, error)
+	EditMessage(channelID string, messageID string, content string) error
+	ListManifest(before string, after string, limit int) ([]*discordMessage, error)
+	Delete(channelID string, messageIDs []string) error
+}
+
+var (
+	backend   Backend
+	idHistory = make([]string, 0)
+)
+
+func newBackend() (Backend, error) {
+	switch config.String("backend") {
+	case "", "discord":
+		return newDiscordBackend(config.String("discord_token"), config.String("server_id"))
+	case "local":
+		return newLocalBackend(config.String("local_path"))
+	}
+
+	return nil, fmt.Errorf("unknown backend %q", config.String("backend"))
+}
+
+func intialize() {
+	err := backend.Init()
+	if len(replicas) > 0 {
+		replicas[0].err = err
+	}
+
+	if err != nil {
+		logger.Printf("Error initializing backend: %v\n", err)
+	} else {
+		logger.Printf("Found manifest channel: %s\nFound %d data channels\n", backend.ManifestChannel(), len(backend.DataChannels()))
+	}
+
+	initReplicas()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// cdcChunker finds content-defined chunk boundaries with FastCDC: a gear hash rolls over the data and
+// a chunk ends where its top bits are zero. A stricter mask is used below the average size and a looser
+// one above it, which keeps chunk sizes close to the average. Because boundaries depend on the content
+// around them, inserting or removing bytes only changes the chunks near the edit.
+type cdcChunker struct {
+	gear    [256]uint64
+	minSize int
+	avgSize int
+	maxSize int
+	maskS   uint64
+	maskL   uint64
+}
+
+// newCDCChunker derives the gear table from key, so chunk boundaries don't reveal anything about the
+// content to someone without it. maxSize is the largest chunk an attachment can hold.
+func newCDCChunker(key []byte, avgSize int, maxSize int) (*cdcChunker, error) {
+	if avgSize <= 0 || avgSize > maxSize/2 {
+		avgSize = maxSize / 4
+	}
+
+	level := bits.Len(uint(avgSize)) - 1
+	if level < 8 {
+		return nil, fmt.Errorf("average chunk size %d is too small", avgSize)
+	}
+
+	c := &cdcChunker{
+		minSize: avgSize / 4,
+		avgSize: avgSize,
+		maxSize: maxSize,
+		maskS:   ^uint64(0) << (64 - (level + 1)),
+		maskL:   ^uint64(0) << (64 - (level - 1)),
+	}
+
+	mac := hmac.New(sha256.New, key)
+	for i := range c.gear {
+		mac.Reset()
+		mac.Write([]byte("gear"))
+		mac.Write([]byte{byte(i)})
+		c.gear[i] = binary.BigEndian.Uint64(mac.Sum(nil))
+	}
+
+	return c, nil
+}
+
+// cut returns the length of the first chunk of data, which holds at most maxSize bytes.
+func (c *cdcChunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+
+	normal := c.avgSize
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + c.gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + c.gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
+
+// cuts reads r to the end and returns the end offset of every chunk.
+func (c *cdcChunker) cuts(r io.Reader) ([]int64, error) {
+	buffer := make([]byte, c.maxSize)
+
+	var cuts []int64
+	var offset int64
+	filled := 0
+	eof := false
+
+	for {
+		if !eof {
+			n, err := io.ReadFull(r, buffer[filled:])
+			filled += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		if filled == 0 {
+			return cuts, nil
+		}
+
+		size := c.cut(buffer[:filled])
+		offset += int64(size)
+		cuts = append(cuts, offset)
+
+		filled = copy(buffer, buffer[size:filled])
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"slices"
+	"testing"
+)
+
+func testCuts(t *testing.T, c *cdcChunker, data []byte) []int64 {
+	t.Helper()
+
+	cuts, err := c.cuts(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cuts
+}
+
+func TestCDCCutSizes(t *testing.T) {
+	c, err := newCDCChunker([]byte("key"), 1024, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 200000)
+	io.ReadFull(rand.Reader, data)
+
+	cuts := testCuts(t, c, data)
+	if cuts[len(cuts)-1] != int64(len(data)) {
+		t.Fatalf("last cut at %d of %d bytes", cuts[len(cuts)-1], len(data))
+	}
+
+	previous := int64(0)
+	for n, cut := range cuts {
+		size := cut - previous
+		if size > 4096 || (size < 256 && n < len(cuts)-1) {
+			t.Fatalf("chunk %d is %d bytes", n, size)
+		}
+		previous = cut
+	}
+
+	if average := len(data) / len(cuts); average < 512 || average > 2048 {
+		t.Fatalf("chunks average %d bytes, expected about 1024", average)
+	}
+
+	if empty := testCuts(t, c, nil); len(empty) != 0 {
+		t.Fatalf("empty input has cuts %v", empty)
+	}
+}
+
+func TestCDCEditShiftsBoundaries(t *testing.T) {
+	c, err := newCDCChunker([]byte("key"), 1024, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 100000)
+	io.ReadFull(rand.Reader, data)
+
+	edit := []byte("inserted bytes")
+	edited := append(append(append([]byte{}, data[:50000]...), edit...), data[50000:]...)
+
+	before := make(map[int64]bool)
+	for _, cut := range testCuts(t, c, data) {
+		before[cut] = true
+	}
+
+	cuts := testCuts(t, c, edited)
+	moved := 0
+	for _, cut := range cuts {
+		if cut < 50000 && !before[cut] {
+			t.Fatalf("boundary at %d before the edit moved", cut)
+		}
+		if cut > 50000 && !before[cut-int64(len(edit))] {
+			moved++
+		}
+	}
+	if moved > 2 {
+		t.Fatalf("%d boundaries after the edit moved", moved)
+	}
+}
+
+func TestCDCKeyedBoundaries(t *testing.T) {
+	data := make([]byte, 50000)
+	io.ReadFull(rand.Reader, data)
+
+	a, _ := newCDCChunker([]byte("key a"), 1024, 4096)
+	b, _ := newCDCChunker([]byte("key b"), 1024, 4096)
+	again, _ := newCDCChunker([]byte("key a"), 1024, 4096)
+
+	if cuts := testCuts(t, a, data); !slices.Equal(cuts, testCuts(t, again, data)) {
+		t.Fatal("same key found different boundaries")
+	} else if slices.Equal(cuts, testCuts(t, b, data)) {
+		t.Fatal("different keys found the same boundaries")
+	}
+
+	if _, err := newCDCChunker([]byte("key"), 100, 400); err == nil {
+		t.Fatal("accepted an average chunk size below 256 bytes")
+	}
+}
@@ -4,60 +4,337 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
+	"os"
+	"strings"
+	"sync"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
 )
 
-func generateMeta(filename string, salt []byte) string {
-	meta := filename + "\u0000" + base64.StdEncoding.EncodeToString(salt)
-	return base64.StdEncoding.EncodeToString([]byte(meta))
+const (
+	chunkVersionGCM    = 1
+	chunkVersionShared = 2
+
+	gcmNonceSize  = 12
+	gcmTagSize    = 16
+	chunkOverhead = 1 + gcmNonceSize + gcmTagSize
+
+	fileIDSize = 16
+
+	metaEnvelopePrefix = "v3:"
+	metaChunkNumber    = -2
+	keyChunkNumber     = -3
+	dataKeySize        = 32
+
+	kdfArgon2id      = 0xa2
+	kdfPBKDF2        = 0xb2
+	kdfScrypt        = 0x5c
+	kdfSaltSize      = 16
+	argon2SaltSize   = 1 + 4 + 4 + 1 + kdfSaltSize
+	pbkdf2SaltSize   = 1 + 4 + kdfSaltSize
+	scryptSaltSize   = 1 + 1 + 1 + 1 + kdfSaltSize
+	legacyIterations = 4096
+)
+
+var (
+	saltedKeys   = make(map[string]*saltedKey)
+	saltedKeysMu sync.Mutex
+	keySaltMu    sync.Mutex
+)
+
+type saltedKey struct {
+	once sync.Once
+	key  []byte
+}
+
+// fileMeta is what a meta string describes. Name is the path the file was sent from, relative to the
+// working directory, with forward slashes. ModTime is in Unix nanoseconds. Only the salt, file ID and
+// wrapped data key are readable without the key. The data key is random and wrapped with the key derived
+// from your_key; everything else, the chunks included, is sealed with it. The data key can also be
+// wrapped for recipients, which open it with their identity instead of your_key.
+type fileMeta struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	Chunks      int    `json:"chunks"`
+	Mode        uint32 `json:"mode,omitempty"`
+	ModTime     int64  `json:"mtime,omitempty"`
+	Dir         bool   `json:"dir,omitempty"`
+	Compression string `json:"compression,omitempty"`
+
+	salt          []byte
+	fileID        []byte
+	wrappedKey    []byte
+	recipientKeys [][]byte
+	key           []byte
+	sharedKey     []byte
+	viaIdentity   bool
+}
+
+func generateMeta(meta *fileMeta, key []byte) (string, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := sealChunk(data, key, meta.fileID, metaChunkNumber, true)
+	if err != nil {
+		return "", err
+	}
+
+	return formatSealedMeta(meta.salt, meta.fileID, meta.wrappedKey, meta.recipientKeys, sealed), nil
 }
 
-func parseMeta(meta string) (filename string, salt []byte) {
+func formatSealedMeta(salt []byte, fileID []byte, wrappedKey []byte, recipientKeys [][]byte, sealed []byte) string {
+	keys := []string{base64.StdEncoding.EncodeToString(wrappedKey)}
+	for _, recipientKey := range recipientKeys {
+		keys = append(keys, base64.StdEncoding.EncodeToString(recipientKey))
+	}
+
+	return metaEnvelopePrefix + strings.Join([]string{
+		base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(fileID),
+		strings.Join(keys, ","),
+		base64.StdEncoding.EncodeToString(sealed),
+	}, ":")
+}
+
+// parseMeta decrypts a sealed meta with your_key, or decodes a plaintext one. Plaintext metas come
+// from before chunks were authenticated: they have no size, chunk count or file ID, and their chunks
+// are decoded with the legacy CFB path.
+func parseMeta(meta string) (*fileMeta, error) {
+	if strings.HasPrefix(meta, metaEnvelopePrefix) {
+		return parseSealedMeta(meta)
+	}
+
 	decodedMeta, err := base64.StdEncoding.DecodeString(meta)
 	if err != nil {
-		logger.Printf("Error decoding metadata: %v\n", err)
-		return
+		return nil, fmt.Errorf("error decoding metadata: %v", err)
 	}
 
 	metaSplit := bytes.Split(decodedMeta, []byte("\u0000"))
 	if len(metaSplit) != 2 {
-		logger.Printf("Invalid metadata\n")
-		return
+		return nil, fmt.Errorf("invalid metadata")
 	}
 
-	filename = string(metaSplit[0])
-	salt, err = base64.StdEncoding.DecodeString(string(metaSplit[1]))
+	parsed := &fileMeta{Name: string(metaSplit[0]), Size: -1, Chunks: -1}
+	parsed.salt, err = base64.StdEncoding.DecodeString(string(metaSplit[1]))
 	if err != nil {
-		logger.Printf("Error decoding salt: %v\n", err)
-		return
+		return nil, fmt.Errorf("error decoding salt: %v", err)
 	}
+	parsed.key = cachedSaltedKey(config.String("your_key"), parsed.salt)
 
-	return filename, salt
+	return parsed, nil
 }
 
-func encryptChunk(chunk []byte, key []byte) ([]byte, []byte, error) {
-	block, err := aes.NewCipher(key)
+// splitSealedMeta decodes the fields of a sealed meta: the salt, the file ID, the data key wrapped with
+// your_key followed by the keys wrapped for recipients, separated by commas, and the sealed metadata.
+func splitSealedMeta(meta string) (salt []byte, fileID []byte, wrappedKey []byte, recipientKeys [][]byte, sealed []byte, err error) {
+	fields := strings.Split(strings.TrimPrefix(meta, metaEnvelopePrefix), ":")
+	if len(fields) != 4 {
+		return nil, nil, nil, nil, nil, fmt.Errorf("invalid metadata")
+	}
+
+	keys := strings.Split(fields[2], ",")
+	fields = append(fields[:2], fields[3])
+
+	var decoded [][]byte
+	for _, field := range append(fields, keys...) {
+		value, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil, nil, nil, nil, nil, fmt.Errorf("error decoding metadata: %v", err)
+		}
+		decoded = append(decoded, value)
+	}
+
+	return decoded[0], decoded[1], decoded[3], decoded[4:], decoded[2], nil
+}
+
+func parseSealedMeta(meta string) (*fileMeta, error) {
+	salt, fileID, wrappedKey, recipientKeys, sealed, err := splitSealedMeta(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := &fileMeta{salt: salt, fileID: fileID, wrappedKey: wrappedKey, recipientKeys: recipientKeys}
+
+	parsed.key, parsed.sharedKey, err = openMetaKey(config.String("your_key"), salt, fileID, wrappedKey)
+	if err != nil && len(recipientKeys) > 0 {
+		if key, identityErr := openRecipientKeys(recipientKeys, fileID); identityErr == nil {
+			parsed.key, parsed.viaIdentity, err = key, true, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data key, check your_key: %v", err)
+	}
+
+	data, err := openChunk(sealed, parsed.key, parsed.fileID, metaChunkNumber, true)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting metadata, check your_key: %v", err)
+	}
+
+	if err := json.Unmarshal(data, parsed); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+
+	return parsed, nil
+}
+
+// newFileKey generates the data key of a file and wraps it with kek. Files sent with dedup also wrap
+// the key of their shared chunks, so it can be recovered from the manifest.
+func newFileKey(kek []byte, fileID []byte, sharedKey []byte) (key []byte, wrappedKey []byte, err error) {
+	key = make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, err
+	}
+
+	wrappedKey, err = wrapFileKey(key, sharedKey, kek, fileID)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	ciphertext := make([]byte, aes.BlockSize+len(chunk))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	return key, wrappedKey, nil
+}
+
+func wrapFileKey(key []byte, sharedKey []byte, kek []byte, fileID []byte) ([]byte, error) {
+	keys := append(append([]byte{}, key...), sharedKey...)
+	return sealChunk(keys, kek, fileID, keyChunkNumber, true)
+}
+
+func openFileKey(wrappedKey []byte, kek []byte, fileID []byte) (key []byte, sharedKey []byte, err error) {
+	keys, err := openChunk(wrappedKey, kek, fileID, keyChunkNumber, true)
+	if err != nil {
 		return nil, nil, err
 	}
 
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], chunk)
+	switch len(keys) {
+	case dataKeySize:
+		return keys, nil, nil
+	case 2 * dataKeySize:
+		return keys[:dataKeySize], keys[dataKeySize:], nil
+	}
+
+	return nil, nil, fmt.Errorf("invalid data key")
+}
+
+// openMetaKey unwraps the data key of a meta, along with the shared chunk key of files sent with dedup.
+func openMetaKey(password string, salt []byte, fileID []byte, wrappedKey []byte) (key []byte, sharedKey []byte, err error) {
+	return openFileKey(wrappedKey, cachedSaltedKey(password, salt), fileID)
+}
+
+// rewrapMeta wraps the data key of a meta with a new password, leaving the keys of recipients and the
+// sealed metadata as they are.
+func rewrapMeta(meta string, oldPassword string, newPassword string) (string, error) {
+	if !strings.HasPrefix(meta, metaEnvelopePrefix) {
+		return "", fmt.Errorf("metadata predates sealed metas, send the file again to rekey it")
+	}
+
+	salt, fileID, wrappedKey, recipientKeys, sealed, err := splitSealedMeta(meta)
+	if err != nil {
+		return "", err
+	}
+
+	key, sharedKey, err := openMetaKey(oldPassword, salt, fileID, wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting data key: %v", err)
+	}
+
+	kek, newSalt, err := deriveKey(newPassword)
+	if err != nil {
+		return "", err
+	}
+
+	wrappedKey, err = wrapFileKey(key, sharedKey, kek, fileID)
+	if err != nil {
+		return "", err
+	}
+
+	return formatSealedMeta(newSalt, fileID, wrappedKey, recipientKeys, sealed), nil
+}
+
+func generateFileID() ([]byte, error) {
+	fileID := make([]byte, fileIDSize)
+	if _, err := io.ReadFull(rand.Reader, fileID); err != nil {
+		return nil, err
+	}
+	return fileID, nil
+}
+
+func chunkAdditionalData(version byte, fileID []byte, index int, final bool) []byte {
+	ad := make([]byte, 0, 1+len(fileID)+8+1)
+	ad = append(ad, version)
+	ad = append(ad, fileID...)
+	ad = binary.BigEndian.AppendUint64(ad, uint64(index))
+	if final {
+		ad = append(ad, 1)
+	} else {
+		ad = append(ad, 0)
+	}
+	return ad
+}
+
+// sealChunk encrypts a chunk as version || nonce || AES-256-GCM ciphertext. The file ID, chunk index
+// and whether this is the last chunk are authenticated so reordered, swapped or truncated chains fail to open.
+func sealChunk(chunk []byte, key []byte, fileID []byte, index int, final bool) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 1+gcmNonceSize, chunkOverhead+len(chunk))
+	sealed[0] = chunkVersionGCM
+	nonce := sealed[1 : 1+gcmNonceSize]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(sealed, nonce, chunk, chunkAdditionalData(chunkVersionGCM, fileID, index, final)), nil
+}
+
+func openChunk(sealed []byte, key []byte, fileID []byte, index int, final bool) ([]byte, error) {
+	if len(sealed) < chunkOverhead {
+		return nil, fmt.Errorf("chunk too short, expected at least %d bytes, got %d", chunkOverhead, len(sealed))
+	}
+
+	version := sealed[0]
+	if version != chunkVersionGCM {
+		return nil, fmt.Errorf("unsupported chunk version %d", version)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := sealed[1 : 1+gcmNonceSize]
+	plaintext, err := aead.Open(nil, nonce, sealed[1+gcmNonceSize:], chunkAdditionalData(version, fileID, index, final))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d failed authentication: it was tampered with, corrupted, reordered or the chain is truncated", index)
+	}
 
-	return ciphertext, iv, nil
+	return plaintext, nil
 }
 
+// decrypt reads chunks uploaded before the AEAD format, which were AES-CFB encrypted without authentication.
 func decrypt(encryptedData []byte, key []byte, iv []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -76,20 +353,246 @@ func decrypt(encryptedData []byte, key []byte, iv []byte) ([]byte, error) {
 	return decryptedData, nil
 }
 
-func deriveKey(password string) (key []byte, salt []byte) {
-	salt = make([]byte, 8)
-	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
-		logger.Printf("Error generating salt: %v\n", err)
-		return nil, nil
+// kdfParams returns the parameters of the configured KDF as they are written at the start of a salt.
+func kdfParams() ([]byte, error) {
+	switch config.String("kdf") {
+	case "", "argon2id":
+		params := []byte{kdfArgon2id}
+		params = binary.BigEndian.AppendUint32(params, uint32(config.Int("argon2_time")))
+		params = binary.BigEndian.AppendUint32(params, uint32(config.Int("argon2_memory")))
+		return append(params, byte(config.Int("argon2_threads"))), nil
+	case "scrypt":
+		return []byte{kdfScrypt, byte(config.Int("scrypt_log_n")), byte(config.Int("scrypt_r")), byte(config.Int("scrypt_p"))}, nil
+	case "pbkdf2":
+		return binary.BigEndian.AppendUint32([]byte{kdfPBKDF2}, uint32(config.Int("pbkdf2_iterations"))), nil
+	}
+
+	return nil, fmt.Errorf("unknown kdf %q, expected argon2id, scrypt or pbkdf2", config.String("kdf"))
+}
+
+// newSalt generates a salt for the configured KDF. Salts describe how their key is derived: a KDF tag,
+// its parameters and 16 random bytes. Salts written before the KDF was configurable are 8 random bytes
+// for PBKDF2-SHA256 with 4096 iterations.
+func newSalt() ([]byte, error) {
+	salt, err := kdfParams()
+	if err != nil {
+		return nil, err
+	}
+
+	random := make([]byte, kdfSaltSize)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return nil, err
+	}
+	salt = append(salt, random...)
+
+	if !checkKDFParams(salt) {
+		return nil, fmt.Errorf("kdf parameters are out of range")
+	}
+
+	return salt, nil
+}
+
+// kdfLimit is the largest value of a KDF option accepted from a salt: a few times the configured or
+// default value, whichever is larger, so files keep opening after the option is lowered.
+func kdfLimit(name string) int {
+	return 4 * max(config.Int(name), newDefaultConfig().Int(name))
+}
+
+// checkKDFParams reports whether the parameters in a salt are within bounds, so a meta posted by someone
+// else can't make listing the manifest exhaust memory or spend minutes in the KDF.
+func checkKDFParams(salt []byte) bool {
+	switch {
+	case len(salt) == argon2SaltSize && salt[0] == kdfArgon2id:
+		passes := int(binary.BigEndian.Uint32(salt[1:5]))
+		memory := int(binary.BigEndian.Uint32(salt[5:9]))
+		threads := int(salt[9])
+		return passes >= 1 && passes <= min(64, kdfLimit("argon2_time")) &&
+			threads >= 1 && threads <= kdfLimit("argon2_threads") &&
+			memory >= 8*threads && memory <= min(1<<20, kdfLimit("argon2_memory"))
+	case len(salt) == scryptSaltSize && salt[0] == kdfScrypt:
+		logN, r, p := int(salt[1]), int(salt[2]), int(salt[3])
+		maxLogN := max(config.Int("scrypt_log_n"), newDefaultConfig().Int("scrypt_log_n")) + 2
+		return logN >= 10 && logN <= min(22, maxLogN) &&
+			r >= 1 && r <= kdfLimit("scrypt_r") &&
+			p >= 1 && p <= min(16, kdfLimit("scrypt_p")) && 128*r<<logN <= 1<<30
+	case len(salt) == pbkdf2SaltSize && salt[0] == kdfPBKDF2:
+		iterations := int(binary.BigEndian.Uint32(salt[1:5]))
+		return iterations >= 1 && iterations <= min(10000000, kdfLimit("pbkdf2_iterations"))
+	}
+
+	return false
+}
+
+// kdfKey derives a key with the KDF a salt describes, if its parameters are within bounds.
+func kdfKey(password string, salt []byte) ([]byte, bool) {
+	if !checkKDFParams(salt) {
+		return nil, false
+	}
+
+	switch salt[0] {
+	case kdfArgon2id:
+		return argon2.IDKey([]byte(password), salt[10:], binary.BigEndian.Uint32(salt[1:5]), binary.BigEndian.Uint32(salt[5:9]), salt[9], 32), true
+	case kdfScrypt:
+		key, err := scrypt.Key([]byte(password), salt[4:], 1<<salt[1], int(salt[2]), int(salt[3]), 32)
+		return key, err == nil
+	}
+
+	return pbkdf2.Key([]byte(password), salt[5:], int(binary.BigEndian.Uint32(salt[1:5])), 32, sha256.New), true
+}
+
+// keySalt returns the salt the data keys of new files are wrapped under, kept in key_salt. A new one is
+// created when there is none yet or the KDF options changed.
+func keySalt() ([]byte, error) {
+	keySaltMu.Lock()
+	defer keySaltMu.Unlock()
+
+	params, err := kdfParams()
+	if err != nil {
+		return nil, err
+	}
+
+	file := config.String("key_salt")
+	var salt []byte
+	data, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading %s: %v", file, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &salt); err != nil {
+			return nil, fmt.Errorf("corrupt salt file %s: %v", file, err)
+		}
+	}
+
+	if len(salt) == len(params)+kdfSaltSize && bytes.Equal(salt[:len(params)], params) {
+		return salt, nil
+	}
+
+	if salt, err = newSalt(); err != nil {
+		return nil, fmt.Errorf("error generating salt: %v", err)
+	}
+	if err := saveJSON(file, salt); err != nil {
+		return nil, fmt.Errorf("error writing %s: %v", file, err)
 	}
 
-	key = pbkdf2.Key([]byte(password), salt, 4096, 32, sha256.New)
+	return salt, nil
+}
+
+// deriveKey returns the key the data keys of new files are wrapped with, derived from the password and
+// the stored salt. Each file has a random data key, so the KDF only has to run once per password.
+func deriveKey(password string) (key []byte, salt []byte, err error) {
+	if salt, err = keySalt(); err != nil {
+		return nil, nil, err
+	}
 
-	return key, salt
+	return cachedSaltedKey(password, salt), salt, nil
 }
 
 func deriveSaltedKey(password string, salt []byte) (key []byte) {
-	key = pbkdf2.Key([]byte(password), salt, 4096, 32, sha256.New)
+	if key, ok := kdfKey(password, salt); ok {
+		return key
+	}
+
+	return pbkdf2.Key([]byte(password), salt, legacyIterations, 32, sha256.New)
+}
+
+// cachedSaltedKey remembers derived keys, since listing the manifest decrypts the meta of every
+// entry and files are commonly looked up more than once. Each key is derived once, without holding
+// up lookups of other keys.
+func cachedSaltedKey(password string, salt []byte) []byte {
+	cacheKey := password + "\u0000" + string(salt)
+
+	saltedKeysMu.Lock()
+	entry, ok := saltedKeys[cacheKey]
+	if !ok {
+		entry = &saltedKey{}
+		saltedKeys[cacheKey] = entry
+	}
+	saltedKeysMu.Unlock()
+
+	entry.once.Do(func() {
+		entry.key = deriveSaltedKey(password, salt)
+	})
+	return entry.key
+}
+
+// newSharedChunkKey derives a key for shared chunks from your_key with the configured KDF and a random
+// salt. Once created it is kept in the chunk index and wrapped in the meta of every file using it.
+func newSharedChunkKey() ([]byte, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return nil, fmt.Errorf("error generating salt: %v", err)
+	}
+
+	key, _ := kdfKey(config.String("your_key"), salt)
+	return key, nil
+}
+
+func chunkAddress(key []byte, plaintext []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("address"))
+	mac.Write(plaintext)
+	return mac.Sum(nil)
+}
+
+func addressKey(key []byte, address []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("key"))
+	mac.Write(address)
+	return mac.Sum(nil)
+}
+
+// sealSharedChunk encrypts a chunk that can be referenced by several files. It is laid out like a
+// per-file chunk, but keyed and authenticated by the chunk's address instead of its position in a file;
+// the order of a file's chunks is protected by its index.
+func sealSharedChunk(chunk []byte, key []byte, address []byte) ([]byte, error) {
+	block, err := aes.NewCipher(addressKey(key, address))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 1+gcmNonceSize, chunkOverhead+len(chunk))
+	sealed[0] = chunkVersionShared
+	nonce := sealed[1 : 1+gcmNonceSize]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(sealed, nonce, chunk, append([]byte{chunkVersionShared}, address...)), nil
+}
+
+func openSharedChunk(sealed []byte, key []byte, address []byte) ([]byte, error) {
+	if len(sealed) < chunkOverhead {
+		return nil, fmt.Errorf("chunk too short, expected at least %d bytes, got %d", chunkOverhead, len(sealed))
+	}
+
+	if sealed[0] != chunkVersionShared {
+		return nil, fmt.Errorf("unsupported chunk version %d", sealed[0])
+	}
+
+	block, err := aes.NewCipher(addressKey(key, address))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := sealed[1 : 1+gcmNonceSize]
+	plaintext, err := aead.Open(nil, nonce, sealed[1+gcmNonceSize:], append([]byte{chunkVersionShared}, address...))
+	if err != nil {
+		return nil, fmt.Errorf("shared chunk failed authentication: it was tampered with or corrupted")
+	}
+
+	if !hmac.Equal(chunkAddress(key, plaintext), address) {
+		return nil, fmt.Errorf("chunk does not match its address")
+	}
 
-	return key
+	return plaintext, nil
 }
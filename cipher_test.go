@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSealOpenChunk(t *testing.T) {
+	key := make([]byte, 32)
+	io.ReadFull(rand.Reader, key)
+	fileID, _ := generateFileID()
+
+	plaintext := []byte("a chunk of a file")
+	sealed, err := sealChunk(plaintext, key, fileID, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) != len(plaintext)+chunkOverhead {
+		t.Fatalf("sealed chunk is %d bytes", len(sealed))
+	}
+
+	opened, err := openChunk(sealed, key, fileID, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Fatal("opened chunk differs")
+	}
+
+	otherID, _ := generateFileID()
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+
+	for name, open := range map[string]func() ([]byte, error){
+		"tampered":   func() ([]byte, error) { return openChunk(tampered, key, fileID, 3, false) },
+		"reordered":  func() ([]byte, error) { return openChunk(sealed, key, fileID, 4, false) },
+		"truncated":  func() ([]byte, error) { return openChunk(sealed, key, fileID, 3, true) },
+		"swapped":    func() ([]byte, error) { return openChunk(sealed, key, otherID, 3, false) },
+		"wrong key":  func() ([]byte, error) { return openChunk(sealed, make([]byte, 32), fileID, 3, false) },
+		"too short":  func() ([]byte, error) { return openChunk(sealed[:10], key, fileID, 3, false) },
+		"wrong type": func() ([]byte, error) { return openChunk(append([]byte{9}, sealed[1:]...), key, fileID, 3, false) },
+	} {
+		if _, err := open(); err == nil {
+			t.Fatalf("%s chunk opened", name)
+		}
+	}
+}
+
+func TestSealOpenSharedChunk(t *testing.T) {
+	key := make([]byte, 32)
+	io.ReadFull(rand.Reader, key)
+
+	plaintext := []byte("a chunk several files share")
+	address := chunkAddress(key, plaintext)
+	if !bytes.Equal(address, chunkAddress(key, plaintext)) {
+		t.Fatal("same chunk got different addresses")
+	}
+	if bytes.Equal(address, chunkAddress(make([]byte, 32), plaintext)) {
+		t.Fatal("address doesn't depend on the key")
+	}
+
+	sealed, err := sealSharedChunk(plaintext, key, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := openSharedChunk(sealed, key, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Fatal("opened chunk differs")
+	}
+
+	if _, err := openSharedChunk(sealed, key, chunkAddress(key, []byte("another chunk"))); err == nil {
+		t.Fatal("shared chunk opened under another address")
+	}
+}
+
+func TestSealedMetaRoundTrip(t *testing.T) {
+	setupTest(t)
+
+	kek, salt, err := deriveKey(config.String("your_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileID, _ := generateFileID()
+	sharedKey := make([]byte, dataKeySize)
+	io.ReadFull(rand.Reader, sharedKey)
+
+	key, wrappedKey, err := newFileKey(kek, fileID, sharedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := generateMeta(&fileMeta{Name: "dir/file.txt", Size: 12345, Chunks: 4, Mode: 0o640, ModTime: 42, Compression: "gzip", salt: salt, fileID: fileID, wrappedKey: wrappedKey}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(meta, metaEnvelopePrefix) {
+		t.Fatalf("meta with a wrapped key is %q", meta[:3])
+	}
+	if strings.Contains(meta, "file.txt") {
+		t.Fatal("meta shows the file name")
+	}
+
+	parsed, err := parseMeta(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Name != "dir/file.txt" || parsed.Size != 12345 || parsed.Chunks != 4 || parsed.Mode != 0o640 || parsed.ModTime != 42 || parsed.Compression != "gzip" {
+		t.Fatalf("parsed meta differs: %+v", parsed)
+	}
+	if !bytes.Equal(parsed.key, key) || !bytes.Equal(parsed.sharedKey, sharedKey) || !bytes.Equal(parsed.fileID, fileID) || !bytes.Equal(parsed.salt, salt) {
+		t.Fatal("parsed meta has different keys")
+	}
+
+	config.SetString("your_key", "another key")
+	if _, err := parseMeta(meta); err == nil {
+		t.Fatal("meta opened with another key")
+	}
+}
+
+func TestPlaintextMeta(t *testing.T) {
+	setupTest(t)
+
+	salt := []byte("8 bytes!")
+	meta := base64.StdEncoding.EncodeToString([]byte("old name\u0000" + base64.StdEncoding.EncodeToString(salt)))
+
+	parsed, err := parseMeta(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Name != "old name" || parsed.Size != -1 || parsed.Chunks != -1 || parsed.fileID != nil {
+		t.Fatalf("plaintext meta parsed wrong: %+v", parsed)
+	}
+	if !bytes.Equal(parsed.key, deriveSaltedKey(config.String("your_key"), salt)) {
+		t.Fatal("plaintext meta has the wrong key")
+	}
+
+	// Only the baseline plaintext meta and sealed v3 metas are accepted.
+	withFileID := base64.StdEncoding.EncodeToString([]byte("old name\u0000" + base64.StdEncoding.EncodeToString(salt) + "\u0000" + base64.StdEncoding.EncodeToString(salt)))
+	for _, invalid := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("no separator")), withFileID, "v2:YQ==:YQ==:YQ==", "v3:a:b:c"} {
+		if _, err := parseMeta(invalid); err == nil {
+			t.Fatalf("parsed invalid meta %q", invalid)
+		}
+	}
+}
+
+func TestFileKeyWrapping(t *testing.T) {
+	kek := make([]byte, 32)
+	io.ReadFull(rand.Reader, kek)
+	fileID, _ := generateFileID()
+
+	key, wrappedKey, err := newFileKey(kek, fileID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, sharedKey, err := openFileKey(wrappedKey, kek, fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, key) || sharedKey != nil {
+		t.Fatal("unwrapped keys differ")
+	}
+
+	otherID, _ := generateFileID()
+	if _, _, err := openFileKey(wrappedKey, kek, otherID); err == nil {
+		t.Fatal("wrapped key opened for another file")
+	}
+}
+
+func TestSalts(t *testing.T) {
+	setupTest(t)
+
+	for kdf, size := range map[string]int{"argon2id": argon2SaltSize, "scrypt": scryptSaltSize, "pbkdf2": pbkdf2SaltSize} {
+		config.SetString("kdf", kdf)
+		config.SetInt("argon2_memory", 64)
+		config.SetInt("argon2_time", 1)
+		config.SetInt("scrypt_log_n", 10)
+
+		salt, err := newSalt()
+		if err != nil {
+			t.Fatalf("%s: %v", kdf, err)
+		}
+		if len(salt) != size {
+			t.Fatalf("%s salt is %d bytes", kdf, len(salt))
+		}
+
+		key, ok := kdfKey("password", salt)
+		if !ok || len(key) != 32 {
+			t.Fatalf("%s salt doesn't derive a key", kdf)
+		}
+		if !bytes.Equal(deriveSaltedKey("password", salt), key) {
+			t.Fatalf("%s key differs when derived again", kdf)
+		}
+	}
+
+	config.SetString("kdf", "bcrypt")
+	if _, err := newSalt(); err == nil {
+		t.Fatal("accepted an unknown kdf")
+	}
+
+	config.SetString("kdf", "pbkdf2")
+	config.SetInt("pbkdf2_iterations", 0)
+	if _, err := newSalt(); err == nil {
+		t.Fatal("accepted out of range kdf parameters")
+	}
+
+	// Salts someone else posted can't ask for unbounded memory.
+	greedy := append([]byte{kdfArgon2id, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff, 1}, make([]byte, kdfSaltSize)...)
+	if _, ok := kdfKey("password", greedy); ok {
+		t.Fatal("derived a key with 4 TiB of Argon2 memory")
+	}
+}
+
+func TestKeySalt(t *testing.T) {
+	setupTest(t)
+
+	keyA, saltA, err := deriveKey("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyB, saltB, err := deriveKey("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files share the salt and key encryption key, their data keys are what differs.
+	if !bytes.Equal(saltA, saltB) || !bytes.Equal(keyA, keyB) {
+		t.Fatal("the salt isn't reused")
+	}
+	if !bytes.Equal(cachedSaltedKey("password", saltA), keyA) {
+		t.Fatal("derived key isn't the one for its salt")
+	}
+
+	// The salt is kept across runs.
+	saltedKeys = make(map[string]*saltedKey)
+	if _, salt, _ := deriveKey("password"); !bytes.Equal(salt, saltA) {
+		t.Fatal("the stored salt wasn't used")
+	}
+
+	config.SetInt("pbkdf2_iterations", 2000)
+	keyC, saltC, err := deriveKey("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(saltC, saltA) || bytes.Equal(keyC, keyA) {
+		t.Fatal("the salt was kept after the kdf options changed")
+	}
+
+	os.WriteFile(config.String("key_salt"), []byte("not json"), 0o600)
+	if _, _, err := deriveKey("password"); err == nil {
+		t.Fatal("a damaged salt file was replaced")
+	}
+}
+
+func TestKDFLimits(t *testing.T) {
+	setupTest(t)
+
+	pbkdf2Salt := func(iterations uint32) []byte {
+		return append(binary.BigEndian.AppendUint32([]byte{kdfPBKDF2}, iterations), make([]byte, kdfSaltSize)...)
+	}
+
+	// Salts are accepted up to a few times the configured or default options, whichever is larger.
+	config.SetInt("pbkdf2_iterations", 1000000)
+	if !checkKDFParams(pbkdf2Salt(4000000)) || checkKDFParams(pbkdf2Salt(4000001)) {
+		t.Fatal("pbkdf2 iterations aren't limited by the configured value")
+	}
+
+	config.SetInt("pbkdf2_iterations", 1000)
+	if !checkKDFParams(pbkdf2Salt(2400000)) || checkKDFParams(pbkdf2Salt(2400001)) {
+		t.Fatal("pbkdf2 iterations aren't limited by the default value")
+	}
+
+	argon2Salt := func(passes uint32, memory uint32, threads byte) []byte {
+		salt := binary.BigEndian.AppendUint32([]byte{kdfArgon2id}, passes)
+		salt = binary.BigEndian.AppendUint32(salt, memory)
+		return append(append(salt, threads), make([]byte, kdfSaltSize)...)
+	}
+	if !checkKDFParams(argon2Salt(12, 256*1024, 16)) {
+		t.Fatal("rejected argon2 parameters within the limits")
+	}
+	for _, salt := range [][]byte{argon2Salt(13, 64*1024, 4), argon2Salt(3, 256*1024+1, 4), argon2Salt(3, 64*1024, 17)} {
+		if checkKDFParams(salt) {
+			t.Fatalf("accepted argon2 parameters %x", salt[1:10])
+		}
+	}
+
+	scryptSalt := func(logN byte) []byte {
+		return append([]byte{kdfScrypt, logN, 8, 1}, make([]byte, kdfSaltSize)...)
+	}
+	if !checkKDFParams(scryptSalt(17)) || checkKDFParams(scryptSalt(18)) {
+		t.Fatal("scrypt cost isn't limited")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Every chunk of a compressed file starts with one of these flags, since chunks that don't shrink
+// are stored as they are.
+const (
+	compressionFlagRaw  = 0
+	compressionFlagGzip = 1
+
+	compressionSampleSize = 64 * 1024
+)
+
+var compressedExtensions = map[string]bool{
+	".7z": true, ".avi": true, ".br": true, ".bz2": true, ".docx": true, ".flac": true, ".gif": true,
+	".gz": true, ".heic": true, ".jar": true, ".jpeg": true, ".jpg": true, ".lz4": true, ".mkv": true,
+	".mov": true, ".mp3": true, ".mp4": true, ".ogg": true, ".pdf": true, ".png": true, ".rar": true,
+	".tgz": true, ".webm": true, ".webp": true, ".xlsx": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+// compressionFor picks the compression of a file from the config, skipping formats that are already
+// compressed.
+func compressionFor(name string) (string, error) {
+	switch config.String("compression") {
+	case "", "none":
+		return "", nil
+	case "gzip":
+		if compressedExtensions[strings.ToLower(path.Ext(name))] {
+			logger.Printf("Not compressing %s, it is already compressed\n", name)
+			return "", nil
+		}
+		return "gzip", nil
+	}
+
+	return "", fmt.Errorf("unknown compression %q, expected none or gzip", config.String("compression"))
+}
+
+func gzipBytes(data []byte) []byte {
+	var b bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&b, gzip.BestSpeed)
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+// compressChunk returns the flagged payload of a chunk. A sample is compressed first, so chunks of
+// random or already compressed data are stored raw without compressing all of them.
+func compressChunk(plaintext []byte) []byte {
+	if len(plaintext) > compressionSampleSize {
+		if sample := gzipBytes(plaintext[:compressionSampleSize]); len(sample) > compressionSampleSize*9/10 {
+			return append([]byte{compressionFlagRaw}, plaintext...)
+		}
+	}
+
+	if compressed := gzipBytes(plaintext); len(compressed) < len(plaintext) {
+		return append([]byte{compressionFlagGzip}, compressed...)
+	}
+
+	return append([]byte{compressionFlagRaw}, plaintext...)
+}
+
+// decompressChunk reverses compressChunk, refusing to inflate past limit bytes.
+func decompressChunk(payload []byte, limit int64) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("compressed chunk is empty")
+	}
+
+	switch payload[0] {
+	case compressionFlagRaw:
+		return payload[1:], nil
+	case compressionFlagGzip:
+		r, err := gzip.NewReader(bytes.NewReader(payload[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing chunk: %v", err)
+		}
+
+		plaintext, err := io.ReadAll(io.LimitReader(r, limit+1))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing chunk: %v", err)
+		}
+		if int64(len(plaintext)) > limit {
+			return nil, fmt.Errorf("chunk decompresses to more than %d bytes", limit)
+		}
+
+		return plaintext, nil
+	}
+
+	return nil, fmt.Errorf("unknown chunk compression %d", payload[0])
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// chunkIndex maps the address of every shared chunk known to be on Discord to the message holding it,
+// along with the key shared chunks are sealed with. It is a local cache: when the file is missing it is
+// rebuilt from the indexes in the manifest channel, and the key from the metas wrapping it.
+type chunkIndex struct {
+	Key    []byte              `json:"key,omitempty"`
+	Chunks map[string]chunkRef `json:"chunks"`
+
+	file string
+	mu   sync.Mutex
+}
+
+var sharedChunks *chunkIndex
+
+func loadChunkIndex() (*chunkIndex, error) {
+	if sharedChunks != nil {
+		return sharedChunks, nil
+	}
+
+	idx := &chunkIndex{Chunks: make(map[string]chunkRef), file: replicaFile(config.String("chunk_index"))}
+
+	data, err := os.ReadFile(idx.file)
+	if os.IsNotExist(err) {
+		if err := idx.rebuild(); err != nil {
+			return nil, err
+		}
+		sharedChunks = idx
+		return idx, idx.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("corrupt chunk index %s: %v", idx.file, err)
+	}
+	if idx.Chunks == nil {
+		idx.Chunks = make(map[string]chunkRef)
+	}
+
+	if idx.Key == nil {
+		if err := idx.recoverKey(); err != nil {
+			return nil, err
+		}
+		sharedChunks = idx
+		return idx, idx.save()
+	}
+
+	sharedChunks = idx
+	return idx, nil
+}
+
+// loadSharedKey returns the key shared chunks are addressed and sealed with on the active replica.
+func loadSharedKey() ([]byte, error) {
+	idx, err := loadChunkIndex()
+	if err != nil {
+		return nil, fmt.Errorf("error loading chunk index: %v", err)
+	}
+
+	return idx.Key, nil
+}
+
+// recoverKey takes the shared chunk key from the newest file that wraps one, so chunks already on
+// Discord keep being reused. Without one a new key is created and chunks recorded so far are dropped,
+// since they can't be under it. If the manifest has entries but none of them open, your_key is most
+// likely wrong, and a new key would stop dedup from reusing anything sent so far.
+func (idx *chunkIndex) recoverKey() error {
+	readable := 0
+	unreadable, err := walkManifest("", "", func(entry *manifestEntry) bool {
+		readable++
+		if entry.sharedKey != nil && !entry.viaIdentity {
+			idx.Key = entry.sharedKey
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %v", err)
+	}
+
+	if idx.Key == nil && unreadable > 0 {
+		if readable == 0 {
+			return fmt.Errorf("none of the %d manifest entries open with your_key, check it before a new shared chunk key is created", unreadable)
+		}
+		logger.Printf("%d manifest entries could not be opened with your_key, a new shared chunk key is created\n", unreadable)
+	}
+
+	if idx.Key == nil {
+		key, err := newSharedChunkKey()
+		if err != nil {
+			return err
+		}
+		idx.Key = key
+		idx.Chunks = make(map[string]chunkRef)
+	}
+
+	return nil
+}
+
+// rebuild reads the index of every file in the manifest channel and records their shared chunks.
+// An index that can't be read fails the rebuild, since its chunks would be missing from the index.
+func (idx *chunkIndex) rebuild() error {
+	logger.Printf("Rebuilding chunk index from the manifest channel\n")
+
+	if err := idx.recoverKey(); err != nil {
+		return err
+	}
+
+	var indexErr error
+	unreadable, err := walkManifest("", "", func(entry *manifestEntry) bool {
+		index, err := sharedChunkIndex(entry)
+		if err != nil {
+			indexErr = fmt.Errorf("%s: %v", entry.name, err)
+			return false
+		}
+		if index == nil {
+			return true
+		}
+
+		for _, ref := range index.Chunks {
+			if ref.Address != nil && ref.Message != "" {
+				idx.Chunks[hex.EncodeToString(ref.Address)] = chunkRef{Channel: ref.Channel, Message: ref.Message, Size: ref.Size}
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %v", err)
+	}
+	if indexErr != nil {
+		return fmt.Errorf("error rebuilding chunk index: %v", indexErr)
+	}
+	if unreadable > 0 {
+		logger.Printf("%d manifest entries could not be opened with your_key, their chunks aren't in the chunk index\n", unreadable)
+	}
+
+	return nil
+}
+
+func (idx *chunkIndex) save() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return saveJSON(idx.file, idx)
+}
+
+func (idx *chunkIndex) add(address []byte, ref chunkRef) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.Chunks[hex.EncodeToString(address)] = chunkRef{Channel: ref.Channel, Message: ref.Message, Size: ref.Size}
+}
+
+func (idx *chunkIndex) forget(messageIDs map[string]bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for address, ref := range idx.Chunks {
+		if messageIDs[ref.Message] {
+			delete(idx.Chunks, address)
+		}
+	}
+}
+
+// reuse looks a chunk up by address and checks its message still holds an attachment of the recorded
+// size. Stale entries are dropped so the chunk is uploaded again.
+func (idx *chunkIndex) reuse(address []byte) (chunkRef, bool) {
+	idx.mu.Lock()
+	ref, ok := idx.Chunks[hex.EncodeToString(address)]
+	idx.mu.Unlock()
+
+	if !ok {
+		return chunkRef{}, false
+	}
+
+	message, err := backend.GetMessage(ref.Channel, ref.Message)
+	if err == nil && len(message.Attachments) > 0 && message.Attachments[0].Size == ref.Size {
+		return ref, true
+	}
+
+	idx.mu.Lock()
+	delete(idx.Chunks, hex.EncodeToString(address))
+	idx.mu.Unlock()
+
+	return chunkRef{}, false
+}
+
+// readFileIndex downloads and opens the index of a file entry.
+func readFileIndex(entry *manifestEntry) (*fileIndex, error) {
+	if entry.index == nil || entry.dir {
+		return nil, fmt.Errorf("%s has no file index", entry.name)
+	}
+
+	sealedIndex, err := backend.GetChunk(*entry.index)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading index: %w", err)
+	}
+
+	index, err := openIndex(sealedIndex, entry.key, entry.fileID)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting index: %v", err)
+	}
+
+	return index, nil
+}
+
+// sharedChunkIndex reads the index of an entry that may hold shared chunks. Directories, files without
+// an index and files whose meta only opens with the identity can't, since shared chunks are sealed with
+// a key derived from your_key; nil is returned for those.
+func sharedChunkIndex(entry *manifestEntry) (*fileIndex, error) {
+	if entry.dir || entry.index == nil || entry.viaIdentity {
+		return nil, nil
+	}
+
+	return readFileIndex(entry)
+}
+
+// chunkUsage finds which shared chunks are still referenced by files other than the ones being
+// deleted. The manifest is only read the first time a shared chunk is looked up. If some entries
+// can't be opened every shared chunk is kept, since they might reference it.
+type chunkUsage struct {
+	exclude    map[string]bool
+	inUse      map[string]bool
+	keepShared bool
+}
+
+func (u *chunkUsage) shared(messageID string) (bool, error) {
+	if u.inUse == nil {
+		inUse := make(map[string]bool)
+
+		var indexErr error
+		unreadable, err := walkManifest("", "", func(entry *manifestEntry) bool {
+			if u.exclude[entry.messageID] {
+				return true
+			}
+
+			index, err := sharedChunkIndex(entry)
+			if err != nil {
+				indexErr = fmt.Errorf("%s: %v", entry.name, err)
+				return false
+			}
+			if index == nil {
+				return true
+			}
+
+			for _, ref := range index.Chunks {
+				if ref.Address != nil {
+					inUse[ref.Message] = true
+				}
+			}
+
+			return true
+		})
+		if err != nil {
+			return false, fmt.Errorf("error reading manifest: %v", err)
+		}
+		if indexErr != nil {
+			return false, fmt.Errorf("can't tell which shared chunks are still in use, error reading the index of %v", indexErr)
+		}
+		if unreadable > 0 {
+			logger.Printf("%d manifest entries could not be opened with your_key, keeping the shared chunks they might use\n", unreadable)
+			u.keepShared = true
+		}
+
+		u.inUse = inUse
+	}
+
+	return u.keepShared || u.inUse[messageID], nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecoverKeyWithWrongKey(t *testing.T) {
+	dir := setupTest(t)
+	config.SetBool("dedup", true)
+
+	path := filepath.Join(dir, "file.bin")
+	writeRandomFile(t, path, 6000)
+	sendTestFile(t, path, 1, nil)
+	key := sharedChunks.Key
+
+	if err := os.Remove(config.String("chunk_index")); err != nil {
+		t.Fatal(err)
+	}
+	sharedChunks = nil
+
+	// Nothing in the manifest opens, so the key is wrong rather than missing.
+	config.SetString("your_key", "wrong key")
+	if _, err := loadSharedKey(); err == nil {
+		t.Fatal("created a new shared chunk key while no entry opened")
+	}
+	if _, err := os.Stat(config.String("chunk_index")); !os.IsNotExist(err) {
+		t.Fatal("chunk index written while no entry opened")
+	}
+
+	entries, unreadable, err := listEntries(nil, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 || unreadable != 1 {
+		t.Fatalf("listed %d entries with %d unreadable", len(entries), unreadable)
+	}
+	if _, err := resolveFile("file.bin"); err == nil || !strings.Contains(err.Error(), "1 entries could not be opened") {
+		t.Fatalf("resolving a file that doesn't open: %v", err)
+	}
+
+	config.SetString("your_key", "test key")
+	recovered, err := loadSharedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recovered, key) {
+		t.Fatal("shared chunk key wasn't recovered from the manifest")
+	}
+}
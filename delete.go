@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// deleteSet groups message IDs by channel, keeping channels in the order they were first seen.
+type deleteSet struct {
+	channels []string
+	messages map[string][]string
+	seen     map[string]bool
+	total    int
+	kept     int
+	shared   bool
+}
+
+func (d *deleteSet) add(channelID string, messageID string, shared bool) {
+	if d.messages == nil {
+		d.messages = make(map[string][]string)
+		d.seen = make(map[string]bool)
+	}
+	if d.seen[messageID] {
+		return
+	}
+	d.seen[messageID] = true
+	d.shared = d.shared || shared
+	if _, ok := d.messages[channelID]; !ok {
+		d.channels = append(d.channels, channelID)
+	}
+	d.messages[channelID] = append(d.messages[channelID], messageID)
+	d.total++
+}
+
+// keep counts a shared chunk that stays because other files still reference it.
+func (d *deleteSet) keep(messageID string) {
+	if d.seen == nil {
+		d.seen = make(map[string]bool)
+	}
+	if !d.seen[messageID] {
+		d.seen[messageID] = true
+		d.kept++
+	}
+}
+
+// collectIndexMessages adds the chunks of an indexed file. Shared chunks that other files still
+// reference are left alone.
+func collectIndexMessages(entry *manifestEntry, set *deleteSet, usage *chunkUsage) error {
+	index, err := readFileIndex(entry)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range index.Chunks {
+		if ref.Message == "" {
+			continue
+		}
+
+		if ref.Address != nil {
+			shared, err := usage.shared(ref.Message)
+			if err != nil {
+				return err
+			}
+			if shared {
+				set.keep(ref.Message)
+				continue
+			}
+		}
+
+		set.add(ref.Channel, ref.Message, ref.Address != nil)
+	}
+
+	for _, ref := range index.Parity {
+		if ref.Message != "" {
+			set.add(ref.Channel, ref.Message, false)
+		}
+	}
+
+	return nil
+}
+
+// collectChainMessages walks a reply chain backwards. A broken chain can't be followed any further, so
+// only the messages after the gap are collected.
+func collectChainMessages(chainEnd string, set *deleteSet) error {
+	message, err := findDataMessage(chainEnd, "")
+	if errors.Is(err, errNotFound) {
+		logger.Printf("Last message %s of the chain is already gone\n", chainEnd)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		set.add(message.ChannelID, message.ID, false)
+
+		logger.AddLine(
+			fmt.Sprintf("resolve_%s", chainEnd),
+			fmt.Sprintf("%s: resolved %d messages", chainEnd, set.total),
+		)
+
+		if message.Reference.MessageID == "" {
+			break
+		}
+
+		hint := message.Reference.ChannelID
+		if hint == "" {
+			hint = previousDataChannel(message.ChannelID)
+		}
+
+		previous, err := findDataMessage(message.Reference.MessageID, hint)
+		if errors.Is(err, errNotFound) {
+			logger.Printf("Chain is broken at %s, earlier chunks can't be found\n", message.Reference.MessageID)
+			break
+		}
+		if err != nil {
+			logger.RemoveLine(fmt.Sprintf("resolve_%s", chainEnd))
+			return err
+		}
+
+		message = previous
+	}
+
+	logger.RemoveLine(fmt.Sprintf("resolve_%s", chainEnd))
+
+	return nil
+}
+
+func deleteFile(query string) error {
+	entry, chainEnd, err := findEntry(query, "deleting")
+	if err != nil {
+		return err
+	}
+
+	if entry == nil {
+		walkManifest("", "", func(e *manifestEntry) bool {
+			if e.reference == chainEnd {
+				entry = e
+				return false
+			}
+			return true
+		})
+	}
+
+	if entry != nil && entry.dir {
+		if err := deleteDirectory(entry); err != nil {
+			return err
+		}
+		return deleteFromReplicas(entry)
+	}
+
+	if entry != nil {
+		parent, err := parentDirectory(entry)
+		if err != nil {
+			return err
+		}
+		if parent != nil {
+			return fmt.Errorf("%s is part of directory %s, delete the directory instead", entry.name, parent.name)
+		}
+	}
+
+	name := query
+	if entry != nil {
+		name = entry.name
+		chainEnd = entry.reference
+	}
+
+	usage := &chunkUsage{exclude: make(map[string]bool)}
+	if entry != nil {
+		usage.exclude[entry.messageID] = true
+	}
+
+	if err := deleteEntry(entry, chainEnd, name, usage); err != nil {
+		return err
+	}
+
+	if entry != nil {
+		return deleteFromReplicas(entry)
+	}
+
+	return nil
+}
+
+// deleteEntry removes the data messages of a file and then its manifest entry, if it has one.
+func deleteEntry(entry *manifestEntry, chainEnd string, name string, usage *chunkUsage) error {
+	logger.Printf("Deleting %s\n", name)
+
+	var err error
+	set := &deleteSet{}
+
+	if entry != nil && entry.index != nil {
+		err = collectIndexMessages(entry, set, usage)
+		if err != nil && chainEnd != "" {
+			logger.Printf("%v, falling back to the reply chain\n", err)
+			err = collectChainMessages(chainEnd, set)
+		}
+	} else if chainEnd != "" {
+		err = collectChainMessages(chainEnd, set)
+	}
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %v", name, err)
+	}
+
+	deleted := 0
+	for _, channelID := range set.channels {
+		messages := set.messages[channelID]
+
+		for len(messages) > 0 {
+			batch := messages
+			if len(batch) > bulkDeleteLimit {
+				batch = batch[:bulkDeleteLimit]
+			}
+			messages = messages[len(batch):]
+
+			if err := backend.Delete(channelID, batch); err != nil {
+				logger.RemoveLine(fmt.Sprintf("delete_%s", name))
+				return fmt.Errorf("error deleting messages of %s, %d of %d deleted: %v", name, deleted, set.total, err)
+			}
+
+			deleted += len(batch)
+
+			logger.AddLine(
+				fmt.Sprintf("delete_%s", name),
+				fmt.Sprintf("%s: deleted %d/%d messages; %s", name, deleted, set.total, ProgressBarUtil(deleted, set.total)),
+			)
+		}
+	}
+
+	logger.RemoveLine(fmt.Sprintf("delete_%s", name))
+
+	if entry != nil {
+		if err := backend.Delete(backend.ManifestChannel(), []string{entry.messageID}); err != nil {
+			return fmt.Errorf("error deleting manifest entry of %s: %v", name, err)
+		}
+	}
+
+	if set.shared {
+		forgetSharedChunks(set)
+	}
+
+	if set.kept > 0 {
+		logger.Printf("Deleted %s, %d messages removed, %d shared chunks kept for other files\n", name, deleted, set.kept)
+	} else {
+		logger.Printf("Deleted %s, %d messages removed\n", name, deleted)
+	}
+
+	return nil
+}
+
+// forgetSharedChunks drops deleted messages from the local chunk index, if there is one, so later
+// sends don't have to find out they are gone.
+func forgetSharedChunks(set *deleteSet) {
+	if sharedChunks == nil {
+		if _, err := os.Stat(replicaFile(config.String("chunk_index"))); err != nil {
+			return
+		}
+	}
+
+	idx, err := loadChunkIndex()
+	if err != nil {
+		return
+	}
+
+	deleted := make(map[string]bool)
+	for _, messages := range set.messages {
+		for _, messageID := range messages {
+			deleted[messageID] = true
+		}
+	}
+
+	idx.forget(deleted)
+
+	if err := idx.save(); err != nil {
+		logger.Printf("Error saving chunk index: %v\n", err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeleteKeepsSharedChunks(t *testing.T) {
+	dir := setupTest(t)
+	config.SetBool("dedup", true)
+
+	first := filepath.Join(dir, "first.bin")
+	data := writeRandomFile(t, first, 12000)
+	sendTestFile(t, first, 2, nil)
+
+	second := filepath.Join(dir, "second.bin")
+	if err := os.WriteFile(second, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sendTestFile(t, second, 2, nil)
+
+	if err := deleteFile("first.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveFile("first.bin"); err == nil {
+		t.Fatal("deleted file is still in the manifest")
+	}
+
+	fetchTestFile(t, "second.bin", data)
+
+	if err := deleteFile("second.bin"); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range sharedChunks.Chunks {
+		if _, err := backend.GetMessage(ref.Channel, ref.Message); err == nil {
+			t.Fatal("chunk index still lists chunks after every file using them was deleted")
+		}
+	}
+	if len(sharedChunks.Chunks) != 0 {
+		t.Fatalf("chunk index kept %d deleted chunks", len(sharedChunks.Chunks))
+	}
+}
+
+func TestDeleteFailsWhenAnIndexIsUnreadable(t *testing.T) {
+	dir := setupTest(t)
+	config.SetBool("dedup", true)
+
+	first := filepath.Join(dir, "first.bin")
+	data := writeRandomFile(t, first, 12000)
+	sendTestFile(t, first, 2, nil)
+
+	second := filepath.Join(dir, "second.bin")
+	if err := os.WriteFile(second, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sendTestFile(t, second, 2, nil)
+
+	// Whether second.bin still uses the chunks of first.bin can't be told without its index.
+	u, err := url.Parse(testEntry(t, "second.bin").index.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := testIndex(t, "first.bin")
+	if err := os.Rename(filepath.FromSlash(u.Path), filepath.FromSlash(u.Path)+".away"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deleteFile("first.bin"); err == nil {
+		t.Fatal("deleted a file while the index of another one was unreadable")
+	}
+	for _, ref := range index.Chunks {
+		if _, err := backend.GetMessage(ref.Channel, ref.Message); err != nil {
+			t.Fatalf("chunk of first.bin was deleted: %v", err)
+		}
+	}
+
+	if err := os.Rename(filepath.FromSlash(u.Path)+".away", filepath.FromSlash(u.Path)); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteFile("first.bin"); err != nil {
+		t.Fatal(err)
+	}
+	fetchTestFile(t, "second.bin", data)
+}
+
+func TestDeleteDirectoryMember(t *testing.T) {
+	dir := setupTest(t)
+
+	root := filepath.Join(dir, "tree")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeRandomFile(t, filepath.Join(root, "a.bin"), 3000)
+	data := writeRandomFile(t, filepath.Join(root, "sub", "b.bin"), 5000)
+
+	sendTestFile(t, root, 1, map[string]string{"r": ""})
+
+	err := deleteFile("b.bin")
+	if err == nil || !strings.Contains(err.Error(), "tree") {
+		t.Fatalf("deleting a member of a directory upload: %v", err)
+	}
+	fetchTestFile(t, "b.bin", data)
+
+	if err := deleteFile("tree"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveFile("b.bin"); err == nil {
+		t.Fatal("member of a deleted directory is still in the manifest")
+	}
+}
+
+func TestDeleteKeepsSharedChunksOfUnreadableEntries(t *testing.T) {
+	dir := setupTest(t)
+	config.SetBool("dedup", true)
+
+	first := filepath.Join(dir, "first.bin")
+	data := writeRandomFile(t, first, 12000)
+	sendTestFile(t, first, 2, nil)
+
+	// second.bin shares the chunks of first.bin but was sent with another key.
+	config.SetString("your_key", "other key")
+	second := filepath.Join(dir, "second.bin")
+	if err := os.WriteFile(second, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sendTestFile(t, second, 2, nil)
+
+	config.SetString("your_key", "test key")
+	if err := deleteFile("first.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	config.SetString("your_key", "other key")
+	fetchTestFile(t, "second.bin", data)
+}
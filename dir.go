@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dirEntry is a file or directory of a directory upload. Path is relative to the uploaded directory,
+// with forward slashes; files point to their own manifest entry through Reference.
+type dirEntry struct {
+	Path      string `json:"path"`
+	Dir       bool   `json:"dir,omitempty"`
+	Mode      uint32 `json:"mode"`
+	ModTime   int64  `json:"mtime"`
+	Size      int64  `json:"size,omitempty"`
+	Chunks    int    `json:"chunks,omitempty"`
+	Reference string `json:"reference,omitempty"`
+}
+
+// dirIndex is attached to a directory's manifest entry in place of a file index, encrypted the same way.
+// Entries are in walk order, so every directory comes before its contents.
+type dirIndex struct {
+	Entries []dirEntry `json:"entries"`
+}
+
+func openDirIndex(entry *manifestEntry) (*dirIndex, error) {
+	if entry.index == nil {
+		return nil, fmt.Errorf("directory %s has no index", entry.name)
+	}
+
+	sealedIndex, err := backend.GetChunk(*entry.index)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading index: %w", err)
+	}
+
+	data, err := openChunk(sealedIndex, entry.key, entry.fileID, indexChunkNumber, true)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting index: %v", err)
+	}
+
+	var index dirIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+
+	return &index, nil
+}
+
+// memberEntry reads the manifest entry of a file in a directory upload.
+func memberEntry(member dirEntry) (*manifestEntry, error) {
+	message, err := backend.GetMessage(backend.ManifestChannel(), member.Reference)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseManifestEntry(message)
+}
+
+// parentDirectory finds the directory upload a file entry belongs to, if any. Directories whose index
+// can't be read make it fail, since the file might be one of their members.
+func parentDirectory(entry *manifestEntry) (*manifestEntry, error) {
+	var parent *manifestEntry
+	var indexErr error
+
+	_, err := walkManifest("", "", func(e *manifestEntry) bool {
+		if !e.dir {
+			return true
+		}
+
+		index, err := openDirIndex(e)
+		if err != nil {
+			indexErr = fmt.Errorf("error reading directory %s: %v", e.name, err)
+			return false
+		}
+
+		for _, member := range index.Entries {
+			if member.Reference == entry.messageID {
+				parent = e
+				return false
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %v", err)
+	}
+	if indexErr != nil {
+		return nil, indexErr
+	}
+
+	return parent, nil
+}
+
+// sendDirectory uploads every regular file under root as its own manifest entry, then posts an entry
+// for the directory that lists them. Symlinks and other special files are skipped.
+func sendDirectory(root string, workers int, resume bool, flags map[string]string) error {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
+	}
+
+	var members []dirEntry
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() && !d.Type().IsRegular() {
+			logger.Printf("Skipping %s, not a regular file\n", path)
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		members = append(members, dirEntry{
+			Path:    filepath.ToSlash(rel),
+			Dir:     d.IsDir(),
+			Mode:    uint32(info.Mode().Perm()),
+			ModTime: info.ModTime().UnixNano(),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error reading directory %s: %v", root, err)
+	}
+
+	var journal *dirJournal
+	if resume {
+		if journal, err = loadDirJournal(root); os.IsNotExist(err) {
+			return fmt.Errorf("no unfinished upload of %s to resume", root)
+		}
+	} else {
+		if previous, err := loadDirJournal(root); err == nil {
+			logger.Printf("Starting %s over, abandoning %d files of its unfinished upload\n", root, len(previous.Files))
+		}
+		journal, err = newDirJournal(root)
+	}
+	if err != nil {
+		return fmt.Errorf("error opening upload journal: %v", err)
+	}
+
+	files := 0
+	for _, member := range members {
+		if !member.Dir {
+			files++
+		}
+	}
+
+	var size int64
+	var chunks int
+	sent := 0
+
+	for i, member := range members {
+		if member.Dir {
+			continue
+		}
+
+		sent++
+
+		if done, ok := journal.Files[member.Path]; ok {
+			members[i] = done
+			size += done.Size
+			chunks += done.Chunks
+			continue
+		}
+
+		path := filepath.Join(root, filepath.FromSlash(member.Path))
+
+		var cf *chunkedFile
+		if _, journalErr := loadJournal(path); resume && journalErr == nil {
+			cf, err = resumeChunkedFile(path)
+		} else {
+			cf, err = chunkFile(path)
+		}
+		if err != nil {
+			return fmt.Errorf("error chunking file: %v", err)
+		}
+
+		if ratio, ok := flags["parity"]; ok {
+			if err := applyParity(cf, ratio); err != nil {
+				cf.Close()
+				return err
+			}
+		}
+
+		if list, ok := flags["recipients"]; ok {
+			if err := applyRecipients(cf, list); err != nil {
+				cf.Close()
+				return err
+			}
+		}
+
+		logger.Printf("Streaming file %s in %d chunks (%d/%d)\n", cf.name, cf.chunks, sent, files)
+
+		reference, err := sendChunkedFile(cf, workers)
+		cf.Close()
+		if err != nil {
+			logger.Printf("Aborting send of %s. %d/%d files were uploaded, run \"send -r %s --resume\" to continue\n", root, len(journal.Files), files, root)
+			return err
+		}
+
+		members[i].Size = cf.size
+		members[i].Chunks = cf.chunks
+		members[i].Reference = reference
+
+		if err := journal.record(members[i]); err != nil {
+			return fmt.Errorf("error writing upload journal: %v", err)
+		}
+
+		size += cf.size
+		chunks += cf.chunks
+	}
+
+	kek, salt, err := deriveKey(config.String("your_key"))
+	if err != nil {
+		return err
+	}
+
+	fileID, err := generateFileID()
+	if err != nil {
+		return err
+	}
+
+	key, wrappedKey, err := newFileKey(kek, fileID, nil)
+	if err != nil {
+		return err
+	}
+
+	list := config.String("recipients")
+	if value, ok := flags["recipients"]; ok {
+		list = value
+	}
+
+	recipients, err := parseRecipients(list)
+	if err != nil {
+		return err
+	}
+
+	recipientKeys, err := wrapForRecipients(key, recipients, fileID)
+	if err != nil {
+		return err
+	}
+
+	name := normalizePath(root)
+
+	metaString, err := generateMeta(&fileMeta{
+		Name:          name,
+		Size:          size,
+		Chunks:        chunks,
+		Mode:          uint32(stat.Mode().Perm()),
+		ModTime:       stat.ModTime().UnixNano(),
+		Dir:           true,
+		salt:          salt,
+		fileID:        fileID,
+		wrappedKey:    wrappedKey,
+		recipientKeys: recipientKeys,
+	}, key)
+	if err != nil {
+		return fmt.Errorf("error encrypting metadata: %v", err)
+	}
+
+	if err := checkManifestEntry(metaString); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&dirIndex{Entries: members})
+	if err != nil {
+		return err
+	}
+
+	sealedIndex, err := sealChunk(data, key, fileID, indexChunkNumber, true)
+	if err != nil {
+		return fmt.Errorf("error encrypting index: %v", err)
+	}
+
+	reference, err := backend.PutManifest(messageCreate{
+		Content:  formatManifestEntry(metaString, ""),
+		Data:     sealedIndex,
+		FileName: indexFileName,
+	})
+	if err != nil {
+		return fmt.Errorf("error sending manifest, run \"send -r %s --resume\" to retry: %v", root, err)
+	}
+
+	journal.remove()
+
+	logger.Printf("Sent directory %s with %d files, reference %s\n", name, files, reference)
+
+	rememberName(name)
+
+	idHistory = append(idHistory, reference)
+
+	return nil
+}
+
+// fetchDirectory recreates a directory upload under its output path. Permissions and modification
+// times of directories are restored last, deepest first, since writing files into them changes both.
+// Like for files, only permission bits are restored.
+func fetchDirectory(entry *manifestEntry, version int, options fetchOptions) error {
+	index, err := openDirIndex(entry)
+	if err != nil {
+		return fmt.Errorf("error fetching directory: %v", err)
+	}
+
+	root := outputPath(entry.name, version, options)
+
+	logger.Printf("Fetching directory %s to %s\n", entry.name, root)
+
+	files := 0
+	for _, member := range index.Entries {
+		if !member.Dir {
+			files++
+		}
+	}
+
+	fetched := 0
+	for _, member := range index.Entries {
+		path := filepath.Join(root, filepath.FromSlash(normalizePath(filepath.FromSlash(member.Path))))
+
+		if member.Dir {
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fetched++
+
+		if options.resume {
+			if stat, err := os.Stat(path); err == nil && stat.Size() == member.Size && stat.ModTime().Equal(time.Unix(0, member.ModTime)) {
+				if _, err := os.Stat(path + ".progress"); os.IsNotExist(err) {
+					logger.Printf("Skipping %s, already fetched\n", path)
+					continue
+				}
+			}
+		}
+
+		fileEntry, err := memberEntry(member)
+		if err != nil {
+			return fmt.Errorf("error reading manifest entry of %s: %v", member.Path, err)
+		}
+
+		cf, err := fetchEntry(fileEntry)
+		if err != nil {
+			return fmt.Errorf("error fetching file %s: %v", member.Path, err)
+		}
+
+		logger.Printf("Decrypting and reconstructing file %s (%d/%d)\n", cf.name, fetched, files)
+
+		if err := reconstructFile(cf, path, options); err != nil {
+			return err
+		}
+	}
+
+	for n := len(index.Entries) - 1; n >= 0; n-- {
+		member := index.Entries[n]
+		if !member.Dir {
+			continue
+		}
+
+		path := filepath.Join(root, filepath.FromSlash(normalizePath(filepath.FromSlash(member.Path))))
+		if err := os.Chmod(path, os.FileMode(member.Mode).Perm()); err != nil {
+			return fmt.Errorf("error restoring permissions of %s: %v", path, err)
+		}
+		if err := os.Chtimes(path, time.Unix(0, member.ModTime), time.Unix(0, member.ModTime)); err != nil {
+			return fmt.Errorf("error restoring modification time of %s: %v", path, err)
+		}
+	}
+
+	logger.Printf("Fetched directory %s\n", entry.name)
+
+	return nil
+}
+
+func deleteDirectory(entry *manifestEntry) error {
+	index, err := openDirIndex(entry)
+	if err != nil {
+		return fmt.Errorf("error reading directory %s: %v", entry.name, err)
+	}
+
+	usage := &chunkUsage{exclude: map[string]bool{entry.messageID: true}}
+	for _, member := range index.Entries {
+		if member.Reference != "" {
+			usage.exclude[member.Reference] = true
+		}
+	}
+
+	for _, member := range index.Entries {
+		if member.Dir || member.Reference == "" {
+			continue
+		}
+
+		fileEntry, err := memberEntry(member)
+		if errors.Is(err, errNotFound) {
+			logger.Printf("%s is already deleted\n", member.Path)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading manifest entry of %s: %v", member.Path, err)
+		}
+
+		if err := deleteEntry(fileEntry, fileEntry.reference, fileEntry.name, usage); err != nil {
+			return err
+		}
+	}
+
+	if err := backend.Delete(backend.ManifestChannel(), []string{entry.messageID}); err != nil {
+		return fmt.Errorf("error deleting manifest entry of %s: %v", entry.name, err)
+	}
+
+	logger.Printf("Deleted directory %s\n", entry.name)
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchDirectory(t *testing.T) {
+	dir := setupTest(t)
+
+	root := filepath.Join(dir, "tree")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	a := writeRandomFile(t, filepath.Join(root, "a.bin"), 3000)
+	b := writeRandomFile(t, filepath.Join(root, "sub", "b.bin"), 5000)
+	if err := os.Chmod(filepath.Join(root, "sub"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+
+	sendTestFile(t, root, 1, map[string]string{"r": ""})
+
+	// Whoever shared the directory wrote its index and can ask for any mode.
+	entry := testEntry(t, "tree")
+	index, err := openDirIndex(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range index.Entries {
+		if index.Entries[i].Dir {
+			index.Entries[i].Mode |= uint32(os.ModeSetgid | os.ModeSticky)
+		}
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealChunk(data, entry.key, entry.fileID, indexChunkNumber, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(entry.index.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.FromSlash(u.Path), sealed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "fetched")
+	if err := fetchFile("tree", map[string]string{"output": output}); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string][]byte{"a.bin": a, "sub/b.bin": b} {
+		if got, err := os.ReadFile(filepath.Join(output, filepath.FromSlash(path))); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s differs: %v", path, err)
+		}
+	}
+
+	// Directory permissions come back without the setgid and sticky bits.
+	if stat, err := os.Stat(filepath.Join(output, "sub")); err != nil {
+		t.Fatal(err)
+	} else if stat.Mode() != os.ModeDir|0o750 {
+		t.Fatalf("fetched directory has mode %v", stat.Mode())
+	}
+}
@@ -7,33 +7,38 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
-	"strconv"
-	"strings"
+	"time"
 )
 
 const (
 	apiBase = "https://discord.com/api/v10"
-)
 
-var (
-	token     string
-	idHistory = make([]string, 0)
+	bulkDeleteLimit  = 100
+	bulkDeleteMaxAge = 14 * 24 * time.Hour
 )
 
-func requestHeaders() *http.Header {
+type discordBackend struct {
+	token             string
+	serverID          string
+	manfiestChannelID string
+	dataChannels      []string
+}
+
+func (b *discordBackend) requestHeaders() *http.Header {
 	return &http.Header{
-		"Authorization": []string{fmt.Sprintf("Bot %s", token)},
+		"Authorization": []string{fmt.Sprintf("Bot %s", b.token)},
 		"User-Agent":    []string{"DiscordBot (0mlml/discord-fs)"},
 		"Content-Type":  []string{"application/json; charset=utf-8"},
 	}
 }
 
-func setToken(t string) bool {
-	if t == "" {
-		logger.Printf("Token is empty\n")
-		return false
+func newDiscordBackend(token string, serverID string) (*discordBackend, error) {
+	if token == "" {
+		return nil, fmt.Errorf("token is empty")
 	}
 
+	b := &discordBackend{token: token, serverID: serverID}
+
 	req, err := http.NewRequest(
 		"GET",
 		fmt.Sprintf("%s/users/@me", apiBase),
@@ -41,53 +46,44 @@ func setToken(t string) bool {
 	)
 
 	if err != nil {
-		logger.Printf("Error setting token: %v\n", err)
-		return false
+		return nil, err
 	}
 
-	req.Header = *requestHeaders()
-	req.Header.Set("Authorization", fmt.Sprintf("Bot %s", t))
+	req.Header = *b.requestHeaders()
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.do(req)
 
 	if err != nil {
-		logger.Printf("Error setting token: %v\n", err)
-		return false
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode >= 300 {
-		logger.Printf("Error setting token: %v\n", resp.Status)
-		return false
+		return nil, fmt.Errorf("unexpected status checking token: %v", resp.Status)
 	}
 
-	token = t
-
-	return true
+	return b, nil
 }
 
-var (
-	manfiestChannelID string
-	dataChannels      []string
-)
-
-func getChannels() error {
+func (b *discordBackend) getChannels() error {
 	req, err := http.NewRequest(
 		"GET",
-		fmt.Sprintf("%s/guilds/%s/channels", apiBase, config.String("server_id")),
+		fmt.Sprintf("%s/guilds/%s/channels", apiBase, b.serverID),
 		nil,
 	)
 
-	req.Header = *requestHeaders()
-
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	req.Header = *b.requestHeaders()
+
+	resp, err := client.do(req)
 
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode >= 300 {
 		return fmt.Errorf("unexpected status getting channels: %v", resp.Status)
@@ -105,55 +101,122 @@ func getChannels() error {
 		return err
 	}
 
+	b.manfiestChannelID = ""
+	b.dataChannels = nil
+
 	for _, channel := range channels {
 		if channel.Type != 0 {
 			continue
 		}
 		if channel.Topic == "discord-fs-manifest" {
-			manfiestChannelID = channel.ID
+			b.manfiestChannelID = channel.ID
 		} else if channel.Topic == "discord-fs-data" {
-			dataChannels = append(dataChannels, channel.ID)
+			b.dataChannels = append(b.dataChannels, channel.ID)
 		}
 	}
 
 	return nil
 }
 
-type discordAttachment struct {
-	Filename string `json:"filename"`
-	Size     int    `json:"size"`
-	URL      string `json:"url"`
+func (b *discordBackend) createChannel(name string, topic string, t int) error {
+	payload := make(map[string]interface{})
+	payload["name"] = name
+	payload["topic"] = topic
+	payload["type"] = t
+
+	payloadJSON, err := json.Marshal(payload)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(
+		"POST",
+		fmt.Sprintf("%s/guilds/%s/channels", apiBase, b.serverID),
+		bytes.NewBuffer(payloadJSON),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header = *b.requestHeaders()
+
+	resp, err := client.do(req)
+
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 300 {
+		return fmt.Errorf("undexpected response creating channel: %v", resp.Status)
+	}
+
+	return nil
 }
 
-type discordMessageReference struct {
-	MessageID string `json:"message_id"`
+func (b *discordBackend) Init() error {
+	if err := b.getChannels(); err != nil {
+		return fmt.Errorf("error getting channels: %v", err)
+	}
+
+	if b.manfiestChannelID == "" {
+		logger.Printf("Manifest channel not found, creating...\n")
+		if err := b.createChannel("discord-fs-manifest", "discord-fs-manifest", 0); err != nil {
+			return fmt.Errorf("error creating manifest channel: %v", err)
+		}
+
+		if err := b.getChannels(); err != nil {
+			return fmt.Errorf("error getting channels: %v", err)
+		}
+	}
+
+	if len(b.dataChannels) == 0 {
+		logger.Printf("Data channel not found, creating...\n")
+		if err := b.createChannel("discord-fs-data", "discord-fs-data", 0); err != nil {
+			return fmt.Errorf("error creating data channel: %v", err)
+		}
+
+		if err := b.getChannels(); err != nil {
+			return fmt.Errorf("error getting channels: %v", err)
+		}
+	}
+
+	return nil
 }
 
-type discordMessage struct {
-	ID          string                  `json:"id"`
-	Content     string                  `json:"content"`
-	Attachments []discordAttachment     `json:"attachments"`
-	Reference   discordMessageReference `json:"message_reference"`
+func (b *discordBackend) ManifestChannel() string {
+	return b.manfiestChannelID
 }
 
-func getMessage(channelID string, messageID string) (message *discordMessage, err error) {
+func (b *discordBackend) DataChannels() []string {
+	return b.dataChannels
+}
+
+func (b *discordBackend) GetMessage(channelID string, messageID string) (message *discordMessage, err error) {
 	req, err := http.NewRequest(
 		"GET",
 		fmt.Sprintf("%s/channels/%s/messages/%s", apiBase, channelID, messageID),
 		nil,
 	)
 
-	req.Header = *requestHeaders()
-
 	if err != nil {
 		return message, err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	req.Header = *b.requestHeaders()
+
+	resp, err := client.do(req)
 
 	if err != nil {
 		return message, err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return message, fmt.Errorf("message %s in channel %s: %w", messageID, channelID, errNotFound)
+	}
 
 	if resp.StatusCode >= 300 {
 		return message, fmt.Errorf("unexpected status getting message: %v", resp.Status)
@@ -166,93 +229,44 @@ func getMessage(channelID string, messageID string) (message *discordMessage, er
 	return message, nil
 }
 
-func createChannel(name string, topic string, t int) (ch *map[string]interface{}, err error) {
-	payload := make(map[string]interface{})
-	payload["name"] = name
-	payload["topic"] = topic
-	payload["type"] = t
-
-	payloadJSON, err := json.Marshal(payload)
-
-	if err != nil {
-		return nil, err
+func (b *discordBackend) ListManifest(before string, after string, limit int) (messages []*discordMessage, err error) {
+	url := fmt.Sprintf("%s/channels/%s/messages?limit=%d", apiBase, b.manfiestChannelID, limit)
+	if before != "" {
+		url += "&before=" + before
 	}
-
-	req, err := http.NewRequest(
-		"POST",
-		fmt.Sprintf("%s/guilds/%s/channels", apiBase, config.String("server_id")),
-		bytes.NewBuffer(payloadJSON),
-	)
-
-	req.Header = *requestHeaders()
-
-	if err != nil {
-		return nil, err
+	if after != "" {
+		url += "&after=" + after
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	req, err := http.NewRequest("GET", url, nil)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode > 300 {
-		return nil, fmt.Errorf("undexpected response creating channel: %v", resp.Status)
-	}
+	req.Header = *b.requestHeaders()
 
-	return nil, nil
-}
+	resp, err := client.do(req)
 
-func intialize() {
-	if err := getChannels(); err != nil {
-		logger.Printf("Error getting channels: %v", err)
-		return
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	if manfiestChannelID == "" {
-		logger.Printf("Manifest channel not found, creating...\n")
-		if _, err := createChannel("discord-fs-manifest", "discord-fs-manifest", 0); err != nil {
-			panic(fmt.Sprintf("Error creating manifest channel: %v", err))
-		}
-
-		if err := getChannels(); err != nil {
-			logger.Printf("Error getting channels: %v", err)
-			return
-		}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status listing manifest: %v", resp.Status)
 	}
 
-	if len(dataChannels) == 0 {
-		logger.Printf("Data channel not found, creating...\n")
-		if _, err := createChannel("discord-fs-data", "discord-fs-data", 0); err != nil {
-			panic(fmt.Sprintf("Error creating data channel: %v", err))
-		}
-
-		if err := getChannels(); err != nil {
-			logger.Printf("Error getting channels: %v", err)
-			return
-		}
+	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
+		return nil, err
 	}
 
-	logger.Printf("Found manifest channel: %s\nFound %d data channels\n", manfiestChannelID, len(dataChannels))
+	return messages, nil
 }
 
-type messageCreate struct {
-	ChannelID   string
-	ReferenceID string
-	Content     string
-	Data        []byte
-	FileName    string
-}
-
-func sendDiscordAttachment(message messageCreate) (string, error) {
+func (b *discordBackend) PutChunk(message messageCreate) (string, error) {
 	var requestBody bytes.Buffer
-	multipartWriter := multipart.NewWriter(&requestBody)
-
-	fileWriter, err := multipartWriter.CreateFormFile("file", message.FileName)
-	if err != nil {
-		return "", err
-	}
-	fileWriter.Write(message.Data)
+	contentType := "application/json; charset=utf-8"
 
 	payload := make(map[string]interface{})
 	if message.Content != "" {
@@ -265,11 +279,26 @@ func sendDiscordAttachment(message messageCreate) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	_ = multipartWriter.WriteField("payload_json", string(payloadJSON))
 
-	err = multipartWriter.Close()
-	if err != nil {
-		return "", err
+	if message.Data != nil {
+		multipartWriter := multipart.NewWriter(&requestBody)
+
+		fileWriter, err := multipartWriter.CreateFormFile("file", message.FileName)
+		if err != nil {
+			return "", err
+		}
+		fileWriter.Write(message.Data)
+
+		_ = multipartWriter.WriteField("payload_json", string(payloadJSON))
+
+		err = multipartWriter.Close()
+		if err != nil {
+			return "", err
+		}
+
+		contentType = multipartWriter.FormDataContentType()
+	} else {
+		requestBody.Write(payloadJSON)
 	}
 
 	req, err := http.NewRequest(
@@ -282,10 +311,10 @@ func sendDiscordAttachment(message messageCreate) (string, error) {
 		return "", err
 	}
 
-	req.Header = *requestHeaders()
-	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	req.Header = *b.requestHeaders()
+	req.Header.Set("Content-Type", contentType)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.do(req)
 	if err != nil {
 		return "", err
 	}
@@ -308,64 +337,20 @@ func sendDiscordAttachment(message messageCreate) (string, error) {
 	return messageID, nil
 }
 
-func sendChunkedFile(f *chunkedFile) (err error) {
-	metaString := generateMeta(f.name, f.salt)
-
-	dataSize := 0
-	for _, chunk := range f.data {
-		dataSize += len(chunk)
-	}
-
-	lastMessageID := ""
-	attempt := 1
-	for n := 0; n < len(f.data); n++ {
-		message := messageCreate{
-			ChannelID:   dataChannels[n%len(dataChannels)],
-			ReferenceID: lastMessageID,
-			Data:        f.data[n],
-			FileName:    fmt.Sprintf("%d.enc", n),
-		}
-
-		if n == 0 {
-			message.Content = metaString
-		}
-
-		logger.AddLine(
-			fmt.Sprintf("send_%s", f.name),
-			fmt.Sprintf("%s: sending attachment %d (size %d); %s", f.name, n+1, dataSize, ProgressBarUtil(n+1, len(f.data))),
-		)
-
-		lastMessageID, err = sendDiscordAttachment(message)
-
-		if err != nil {
-			logger.Printf("Error sending chunk %d: %v. Attempt %d/%d\n", n, err, attempt, config.Int("max_retry"))
-
-			if attempt >= config.Int("max_retry") {
-				logger.Printf("Aborting send of %s\n", f.name)
-				return err
-			}
-
-			attempt++
-			n--
-		}
-	}
-
-	logger.RemoveLine(fmt.Sprintf("send_%s", f.name))
-	logger.Printf("%s: sending attachment %d (size %d); %s\n", f.name, len(f.data), dataSize, ProgressBarUtil(1, 1))
-
-	var payload = map[string]interface{}{
-		"content": fmt.Sprintf("%s\n%s", metaString, lastMessageID),
-	}
-
-	payloadJSON, err := json.Marshal(payload)
+func (b *discordBackend) PutManifest(message messageCreate) (string, error) {
+	message.ChannelID = b.manfiestChannelID
+	return b.PutChunk(message)
+}
 
+func (b *discordBackend) EditMessage(channelID string, messageID string, content string) error {
+	payloadJSON, err := json.Marshal(map[string]string{"content": content})
 	if err != nil {
 		return err
 	}
 
 	req, err := http.NewRequest(
-		"POST",
-		fmt.Sprintf("%s/channels/%s/messages", apiBase, manfiestChannelID),
+		"PATCH",
+		fmt.Sprintf("%s/channels/%s/messages/%s", apiBase, channelID, messageID),
 		bytes.NewBuffer(payloadJSON),
 	)
 
@@ -373,32 +358,41 @@ func sendChunkedFile(f *chunkedFile) (err error) {
 		return err
 	}
 
-	req.Header = *requestHeaders()
-
-	resp, err := http.DefaultClient.Do(req)
+	req.Header = *b.requestHeaders()
 
+	resp, err := client.do(req)
 	if err != nil {
 		return err
 	}
+	resp.Body.Close()
 
-	if resp.StatusCode >= 300 {
-		return fmt.Errorf("error sending manifest: %v", resp.Status)
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("message %s in channel %s: %w", messageID, channelID, errNotFound)
 	}
 
-	logger.Printf("Sent file %s, reference %s\n", f.name, lastMessageID)
-
-	idHistory = append(idHistory, lastMessageID)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status editing message %s: %v", messageID, resp.Status)
+	}
 
 	return nil
 }
 
-func downloadChunk(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+func (b *discordBackend) GetChunk(attachment discordAttachment) ([]byte, error) {
+	req, err := http.NewRequest("GET", attachment.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("attachment %s: %w", attachment.Filename, errNotFound)
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("failed to download chunk: status code %d", resp.StatusCode)
 	}
@@ -411,92 +405,104 @@ func downloadChunk(url string) ([]byte, error) {
 	return data, nil
 }
 
-func fetchChunkedFile(chainEndId string) (cf *chunkedFile, err error) {
-	cf = &chunkedFile{}
+func (b *discordBackend) deleteMessage(channelID string, messageID string) error {
+	req, err := http.NewRequest(
+		"DELETE",
+		fmt.Sprintf("%s/channels/%s/messages/%s", apiBase, channelID, messageID),
+		nil,
+	)
 
-	lastMessage, err := getMessage(dataChannels[0], chainEndId)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	chunkNumberStr := strings.Split(lastMessage.Attachments[0].Filename, ".")[0]
-	chunkNumber, err := strconv.Atoi(chunkNumberStr)
+	req.Header = *b.requestHeaders()
 
+	resp, err := client.do(req)
 	if err != nil {
-		logger.Printf("Error parsing chunk number: %v\n", err)
-		chunkNumber = -1
+		return err
 	}
+	resp.Body.Close()
 
-	chunkNumber++
-
-	chunkCount := chunkNumber
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected status deleting message %s: %v", messageID, resp.Status)
+	}
 
-	logger.Printf("Starting download for reference %s, inferring %d chunks\n", chainEndId, chunkNumber)
-	logger.AddLine(
-		fmt.Sprintf("download_%s", chainEndId),
-		fmt.Sprintf("%s: downloading attachment %d (size %d); %s", chainEndId, chunkNumber, lastMessage.Attachments[0].Size, ProgressBarUtil(chunkCount-chunkNumber, chunkCount)),
-	)
+	return nil
+}
 
-	logger.Flush()
+// bulkDelete removes 2 to 100 messages younger than two weeks in one request. Discord rejects the
+// whole batch if any of them is too old or missing, in which case they are deleted one by one.
+func (b *discordBackend) bulkDelete(channelID string, messageIDs []string) error {
+	payloadJSON, err := json.Marshal(map[string][]string{"messages": messageIDs})
+	if err != nil {
+		return err
+	}
 
-	data, err := downloadChunk(lastMessage.Attachments[0].URL)
+	req, err := http.NewRequest(
+		"POST",
+		fmt.Sprintf("%s/channels/%s/messages/bulk-delete", apiBase, channelID),
+		bytes.NewBuffer(payloadJSON),
+	)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	cf.data = append(cf.data, data)
+	req.Header = *b.requestHeaders()
 
-	metaString := ""
-	for {
-		metaString = lastMessage.Content
+	resp, err := client.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
 
-		if lastMessage.Reference.MessageID == "" {
-			break
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotFound {
+		for _, messageID := range messageIDs {
+			if err := b.deleteMessage(channelID, messageID); err != nil {
+				return err
+			}
 		}
+		return nil
+	}
 
-		lastMessage, err = getMessage(dataChannels[0], lastMessage.Reference.MessageID)
-		if err != nil {
-			return nil, err
-		}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status bulk deleting messages: %v", resp.Status)
+	}
 
-		chunkNumberStr = strings.Split(lastMessage.Attachments[0].Filename, ".")[0]
+	return nil
+}
 
-		chunkNumber, err := strconv.Atoi(chunkNumberStr)
+func (b *discordBackend) Delete(channelID string, messageIDs []string) error {
+	// Leave some slack so a message doesn't age past the limit between here and the request.
+	cutoff := time.Now().Add(-bulkDeleteMaxAge + time.Hour)
 
-		if err != nil {
-			logger.Printf("Error parsing chunk number: %v\n", err)
-			chunkNumber = -1
+	var recent []string
+	for _, messageID := range messageIDs {
+		if snowflakeTime(messageID).After(cutoff) {
+			recent = append(recent, messageID)
+		} else if err := b.deleteMessage(channelID, messageID); err != nil {
+			return err
 		}
+	}
 
-		chunkNumber++
-
-		logger.AddLine(
-			fmt.Sprintf("download_%s", chainEndId),
-			fmt.Sprintf("%s: downloading attachment %d (size %d); %s", chainEndId, chunkNumber, lastMessage.Attachments[0].Size, ProgressBarUtil(chunkCount-chunkNumber, chunkCount)),
-		)
-
-		logger.Flush()
-
-		data, err := downloadChunk(lastMessage.Attachments[0].URL)
+	for len(recent) > 0 {
+		batch := recent
+		if len(batch) > bulkDeleteLimit {
+			batch = batch[:bulkDeleteLimit]
+		}
+		recent = recent[len(batch):]
 
+		var err error
+		if len(batch) == 1 {
+			err = b.deleteMessage(channelID, batch[0])
+		} else {
+			err = b.bulkDelete(channelID, batch)
+		}
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		cf.data = append(cf.data, data)
-	}
-
-	for i := len(cf.data)/2 - 1; i >= 0; i-- {
-		opp := len(cf.data) - 1 - i
-		cf.data[i], cf.data[opp] = cf.data[opp], cf.data[i]
 	}
 
-	cf.name, cf.salt = parseMeta(metaString)
-
-	logger.Printf("%s: downloading attachment %d (size %d); %s", chainEndId, chunkNumber, lastMessage.Attachments[0].Size, ProgressBarUtil(1, 1))
-	logger.RemoveLine(fmt.Sprintf("download_%s", chainEndId))
-	logger.Printf("Fetched file %s out of %d chunks\n", cf.name, len(cf.data))
-
-	return cf, nil
+	return nil
 }
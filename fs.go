@@ -1,96 +1,591 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 type chunkedFile struct {
-	name string
-	salt []byte
-	data [][]byte
+	path          string
+	name          string
+	salt          []byte
+	fileID        []byte
+	wrappedKey    []byte
+	recipients    []string
+	recipientKeys [][]byte
+	key           []byte
+	sharedKey     []byte
+	size          int64
+	chunks        int
+	index         int
+	file          *os.File
+	buffer        []byte
+	messages      []*discordMessage
+	journal       *uploadJournal
+	fileHash      hash.Hash
+	hashes        [][]byte
+	wantHash      []byte
+	mode          os.FileMode
+	modTime       time.Time
+	dedup         bool
+	reused        int
+	addresses     [][]byte
+	chunker       string
+	cuts          []int64
+	compression   string
+	lengths       []int64
+	parityData    int
+	parityShards  int
+	parityRefs    []chunkRef
+	sizes         []int
+	recovered     map[int][]byte
+	recoverMu     sync.Mutex
 }
 
-func chunkFile(path string) (f *chunkedFile, err error) {
-	var file *os.File
-	file, err = os.Open(path)
+// normalizePath turns a path into the name a file is stored under: relative to the working
+// directory, cleaned and with forward slashes. Paths outside the working directory keep only their
+// base name, so a fetch never writes above it.
+func normalizePath(path string) string {
+	if filepath.IsAbs(path) {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, path); err == nil {
+				path = rel
+			}
+		}
+	}
+
+	path = filepath.Clean(path)
+	if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		path = filepath.Base(path)
+	}
+
+	return filepath.ToSlash(path)
+}
+
+// openChunkedFile opens a file to be sent and works out how it is chunked, leaving the keys to the caller.
+func openChunkedFile(path string) (*chunkedFile, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		return
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if !stat.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	compression, err := compressionFor(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	chunkSize := config.Int("max_file_size") - chunkOverhead
+	if compression != "" {
+		chunkSize--
+	}
+
+	f := &chunkedFile{}
+
+	f.path = path
+	f.name = normalizePath(path)
+	f.size = stat.Size()
+	f.chunks = int((f.size + int64(chunkSize) - 1) / int64(chunkSize))
+	if f.chunks == 0 {
+		f.chunks = 1
+	}
+	f.file = file
+	f.buffer = make([]byte, chunkSize)
+	f.fileHash = sha256.New()
+	f.mode = stat.Mode().Perm()
+	f.modTime = stat.ModTime()
+	f.compression = compression
+
+	switch f.chunker = config.String("chunker"); f.chunker {
+	case "", "fixed":
+		f.chunker = "fixed"
+	case "fastcdc":
+	default:
+		file.Close()
+		return nil, fmt.Errorf("unknown chunker %q, expected fixed or fastcdc", f.chunker)
 	}
-	defer file.Close()
 
-	key, salt := deriveKey(config.String("your_key"))
+	return f, nil
+}
+
+func chunkFile(path string) (*chunkedFile, error) {
+	f, err := openChunkedFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	kek, salt, err := deriveKey(config.String("your_key"))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 
-	f = &chunkedFile{}
+	if f.fileID, err = generateFileID(); err != nil {
+		f.Close()
+		return nil, err
+	}
 
-	f.name = file.Name()
 	f.salt = salt
+	if f.key, f.wrappedKey, err = newFileKey(kek, f.fileID, nil); err != nil {
+		f.Close()
+		return nil, err
+	}
 
-	chunkSize := config.Int("max_file_size") - aes.BlockSize
-
-	chunkNumber := 0
-	buffer := make([]byte, chunkSize)
-	for {
-		var bytesRead int
-		bytesRead, err = file.Read(buffer)
-		if bytesRead > 0 {
-			encryptedData, iv, encryptErr := encryptChunk(buffer[:bytesRead], key)
-			if encryptErr != nil {
-				fmt.Printf("Error encrypting chunk: %v\n", encryptErr)
-				return nil, encryptErr
-			}
+	if f.parityData, f.parityShards, err = parseParity(config.String("parity")); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := applyRecipients(f, config.String("recipients")); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if f.chunker == "fastcdc" {
+		if err := f.contentDefinedChunks(); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error finding chunk boundaries: %v", err)
+		}
+	}
+
+	return f, nil
+}
+
+// contentDefinedChunks reads the whole file once up front to find its chunk boundaries, so the number
+// of chunks is known before anything is sent. With dedup, boundaries are keyed with the shared chunk
+// key so the same content is cut the same way in every file; otherwise with the data key, so the chunk
+// index isn't needed. Either way they are the same when the upload is resumed.
+func (f *chunkedFile) contentDefinedChunks() error {
+	key := f.key
+	if f.dedup {
+		key = f.sharedKey
+	}
+
+	chunker, err := newCDCChunker(key, config.Int("cdc_avg_size"), len(f.buffer))
+	if err != nil {
+		return err
+	}
+
+	if f.cuts, err = chunker.cuts(f.file); err != nil {
+		return err
+	}
+
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	f.chunks = len(f.cuts)
+	if f.chunks == 0 {
+		f.chunks = 1
+		f.cuts = []int64{0}
+	}
+
+	return nil
+}
+
+func (f *chunkedFile) readChunk() ([]byte, error) {
+	if f.index >= f.chunks {
+		return nil, io.EOF
+	}
+
+	buffer := f.buffer
+	if f.cuts != nil {
+		start := int64(0)
+		if f.index > 0 {
+			start = f.cuts[f.index-1]
+		}
+		buffer = f.buffer[:f.cuts[f.index]-start]
+	}
+
+	bytesRead, err := io.ReadFull(f.file, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("error reading file: %v", err)
+	}
+	if bytesRead == 0 && f.size > 0 {
+		return nil, io.EOF
+	}
+
+	f.fileHash.Write(buffer[:bytesRead])
+
+	return buffer[:bytesRead], nil
+}
+
+// nextChunk reads and encrypts the next chunk, also returning the SHA-256 of its plaintext. With dedup
+// the chunk is sealed as a shared chunk and its address is returned as well.
+func (f *chunkedFile) nextChunk() (uploadJob, error) {
+	plaintext, err := f.readChunk()
+	if err != nil {
+		return uploadJob{}, err
+	}
+
+	job := uploadJob{n: f.index, length: int64(len(plaintext))}
+
+	payload := plaintext
+	if f.compression != "" {
+		payload = compressChunk(plaintext)
+	}
+
+	if f.dedup {
+		job.address = chunkAddress(f.sharedKey, payload)
+		job.data, err = sealSharedChunk(payload, f.sharedKey, job.address)
+	} else {
+		job.data, err = sealChunk(payload, f.key, f.fileID, f.index, f.index == f.chunks-1)
+	}
+	if err != nil {
+		return uploadJob{}, fmt.Errorf("error encrypting chunk: %v", err)
+	}
+
+	sum := sha256.Sum256(plaintext)
+	job.hash = sum[:]
+	f.index++
+
+	return job, nil
+}
+
+// skipChunk reads past a chunk that was already uploaded, checking it still matches the recorded hash
+// and feeding it into the whole-file hash.
+func (f *chunkedFile) skipChunk(want []byte) error {
+	plaintext, err := f.readChunk()
+	if err == io.EOF {
+		return fmt.Errorf("file %s ended early at chunk %d of %d", f.name, f.index, f.chunks)
+	}
+	if err != nil {
+		return err
+	}
+
+	if sum := sha256.Sum256(plaintext); want != nil && !bytes.Equal(sum[:], want) {
+		return fmt.Errorf("chunk %d of %s changed since it was uploaded", f.index, f.name)
+	}
+
+	f.index++
+
+	return nil
+}
+
+func (f *chunkedFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+func decryptChunk(f *chunkedFile, chunk []byte, key []byte, index int) ([]byte, error) {
+	payload, err := openChunkPayload(f, chunk, key, index)
+	if err != nil || f.compression == "" {
+		return payload, err
+	}
+
+	limit := int64(config.Int("max_file_size"))
+	if index < len(f.lengths) {
+		limit = f.lengths[index]
+	}
+
+	return decompressChunk(payload, limit)
+}
+
+func openChunkPayload(f *chunkedFile, chunk []byte, key []byte, index int) ([]byte, error) {
+	if index < len(f.addresses) && f.addresses[index] != nil {
+		if f.sharedKey == nil {
+			return nil, fmt.Errorf("chunk %d is shared but the meta holds no shared chunk key", index)
+		}
+		return openSharedChunk(chunk, f.sharedKey, f.addresses[index])
+	}
+
+	if f.fileID != nil {
+		return openChunk(chunk, key, f.fileID, index, index == f.chunks-1)
+	}
+
+	if len(chunk) < aes.BlockSize {
+		return nil, fmt.Errorf("chunk too short, expected at least %d bytes, got %d", aes.BlockSize, len(chunk))
+	}
+
+	iv := chunk[:aes.BlockSize]
+	encryptedData := chunk[aes.BlockSize:]
+
+	return decrypt(encryptedData, key, iv)
+}
+
+func (f *chunkedFile) verifyChunk(n int, plaintext []byte) error {
+	if n >= len(f.hashes) || f.hashes[n] == nil {
+		return nil
+	}
+
+	if sum := sha256.Sum256(plaintext); !bytes.Equal(sum[:], f.hashes[n]) {
+		return fmt.Errorf("chunk %d does not match its recorded SHA-256", n)
+	}
 
-			var chunk []byte
-			chunk = append(chunk, iv...)
-			chunk = append(chunk, encryptedData...)
-			f.data = append(f.data, chunk)
+	return nil
+}
+
+func verifyFileHash(path string, want []byte) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(h.Sum(nil), want) {
+		return fmt.Errorf("%s does not match the recorded SHA-256 of the file", path)
+	}
 
-			chunkNumber++
+	return nil
+}
+
+// plaintextSize is the size a chunk decrypts to. Compressed chunks can only be sized from the lengths
+// recorded in the index.
+func plaintextSize(f *chunkedFile, n int, encryptedSize int) int64 {
+	if f.compression != "" {
+		return f.lengths[n]
+	}
+	if f.fileID != nil {
+		return int64(encryptedSize - chunkOverhead)
+	}
+	return int64(encryptedSize - 2*aes.BlockSize)
+}
+
+func (f *chunkedFile) downloadChunk(key []byte, n int) ([]byte, error) {
+	attempts := config.Int("max_retry")
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		message := f.messages[n]
+		if message == nil {
+			return nil, fmt.Errorf("chunk %d is missing", n)
 		}
-		if err != nil {
-			if err == io.EOF {
-				break
+		if attempt > 1 && message.ChannelID != "" {
+			if refreshed, err := backend.GetMessage(message.ChannelID, message.ID); err == nil {
+				message = refreshed
+				f.messages[n] = refreshed
 			}
+		}
 
-			fmt.Printf("Error reading file: %v\n", err)
-			break
+		if len(message.Attachments) == 0 {
+			return nil, fmt.Errorf("message %s has no attachment", message.ID)
 		}
+
+		chunk, err := backend.GetChunk(message.Attachments[0])
+		if err == nil {
+			var decryptedData []byte
+			decryptedData, err = decryptChunk(f, chunk, key, n)
+			if err == nil {
+				err = f.verifyChunk(n, decryptedData)
+			}
+			if err == nil {
+				return decryptedData, nil
+			}
+		}
+
+		lastErr = err
+		logger.Printf("Error downloading chunk %d: %v. Attempt %d/%d\n", n, err, attempt, attempts)
 	}
 
-	return f, nil
+	return nil, lastErr
 }
 
-func reconstructFile(f *chunkedFile, outputPath string) error {
-	key := deriveSaltedKey(config.String("your_key"), f.salt)
+// reconstructFile downloads chunks with a bounded pool of workers. Offsets are known up front from the
+// attachment sizes, so every chunk is decrypted and written in place as soon as it arrives.
+func reconstructFile(f *chunkedFile, outputPath string, options fetchOptions) error {
+	key := f.key
+
+	if f.compression != "" && len(f.lengths) != len(f.messages) {
+		return fmt.Errorf("%s is compressed and can only be fetched through its manifest entry", f.name)
+	}
+
+	offsets := make([]int64, len(f.messages))
+	var size int64
+	for n, message := range f.messages {
+		encryptedSize := 0
+		if message != nil && len(message.Attachments) > 0 {
+			encryptedSize = message.Attachments[0].Size
+		} else if f.parityData > 0 {
+			encryptedSize = f.sizes[n]
+		} else {
+			return fmt.Errorf("message %s has no attachment", message.ID)
+		}
+		offsets[n] = size
+		size += plaintextSize(f, n, encryptedSize)
+	}
+
+	if f.size >= 0 && size != f.size {
+		return fmt.Errorf("chunks of %s add up to %d bytes, %d were sent", f.name, size, f.size)
+	}
+
+	var progress *downloadProgress
+	if options.resume {
+		var err error
+		if progress, err = loadDownloadProgress(f, outputPath, size); err != nil {
+			return err
+		}
+		if progress == nil {
+			logger.Printf("No interrupted download of %s at %s, starting from scratch\n", f.name, outputPath)
+		} else {
+			logger.Printf("Resuming %s, %d/%d chunks already downloaded\n", f.name, progress.done(), len(f.messages))
+		}
+	}
+
+	if progress == nil && !options.force {
+		if _, err := os.Stat(outputPath); err == nil {
+			return fmt.Errorf("%s already exists, fetch with --force to overwrite it or pick another path with --output", outputPath)
+		}
+	}
 
-	outputFile, err := os.Create(outputPath)
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0o755); err != nil {
+		return err
+	}
+
+	var outputFile *os.File
+	var err error
+	if progress != nil {
+		outputFile, err = os.OpenFile(outputPath, os.O_WRONLY, 0)
+	} else {
+		outputFile, err = os.Create(outputPath)
+	}
 	if err != nil {
 		return err
 	}
 	defer outputFile.Close()
 
-	for _, chunk := range f.data {
-		if len(chunk) < aes.BlockSize {
-			return fmt.Errorf("chunk too short, expected at least %d bytes, got %d", aes.BlockSize, len(chunk))
+	if progress == nil {
+		if err := outputFile.Truncate(size); err != nil {
+			return err
 		}
 
-		iv := chunk[:aes.BlockSize]
-		encryptedData := chunk[aes.BlockSize:]
+		if progress, err = newDownloadProgress(f, outputPath, size); err != nil {
+			return fmt.Errorf("error writing download progress: %v", err)
+		}
+	}
 
-		decryptedData, decryptErr := decrypt(encryptedData, key, iv)
-		if decryptErr != nil {
-			return fmt.Errorf("error decrypting chunk: %v", decryptErr)
+	workers := options.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	progressKey := fmt.Sprintf("download_%s", f.name)
+	defer logger.RemoveLine(progressKey)
+
+	jobs := make(chan int)
+	failed := make(chan struct{})
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		done     = progress.done()
+	)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for n := range jobs {
+				decryptedData, err := f.downloadChunk(key, n)
+				if err != nil && f.parityData > 0 {
+					logger.Printf("Rebuilding chunk %d of %s from parity: %v\n", n, f.name, err)
+					decryptedData, err = f.recoverChunk(key, n)
+				}
+				if err == nil {
+					if _, writeErr := outputFile.WriteAt(decryptedData, offsets[n]); writeErr != nil {
+						err = fmt.Errorf("error writing to output file: %v", writeErr)
+					} else if syncErr := outputFile.Sync(); syncErr != nil {
+						err = fmt.Errorf("error writing to output file: %v", syncErr)
+					} else if progressErr := progress.markDone(n); progressErr != nil {
+						err = fmt.Errorf("error writing download progress: %v", progressErr)
+					}
+				} else {
+					err = fmt.Errorf("error downloading chunk %d: %v", n, err)
+				}
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+						close(failed)
+					}
+				} else {
+					done++
+					logger.AddLine(
+						progressKey,
+						fmt.Sprintf("%s: downloaded %d/%d attachments (size %d); %s", f.name, done, len(f.messages), size, ProgressBarUtil(done, len(f.messages))),
+					)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for n := range f.messages {
+		if progress.Done[n] {
+			continue
+		}
+
+		select {
+		case jobs <- n:
+		case <-failed:
+			break dispatch
 		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		logger.Printf("Download of %s stopped with %d/%d chunks written, fetch again with --resume to continue\n", f.name, done, len(f.messages))
+		return firstErr
+	}
+
+	if f.wantHash != nil {
+		if err := verifyFileHash(outputPath, f.wantHash); err != nil {
+			return err
+		}
+	}
+
+	progress.remove()
+
+	// Only permission bits are restored. The mode comes from the meta, which whoever shared the file
+	// wrote, so setuid, setgid and sticky bits are dropped.
+	if f.mode != 0 {
+		if err := outputFile.Chmod(f.mode.Perm()); err != nil {
+			return fmt.Errorf("error restoring permissions of %s: %v", outputPath, err)
+		}
+	}
 
-		_, writeErr := outputFile.Write(decryptedData)
-		if writeErr != nil {
-			return fmt.Errorf("error writing to output file: %v", writeErr)
+	if !f.modTime.IsZero() {
+		if err := os.Chtimes(outputPath, f.modTime, f.modTime); err != nil {
+			return fmt.Errorf("error restoring modification time of %s: %v", outputPath, err)
 		}
 	}
 
-	logger.Printf("Reconstructed file %s\n", f.name)
+	logger.Printf("Reconstructed file %s as %s\n", f.name, outputPath)
 
 	return nil
 }
@@ -6,3 +6,5 @@ require (
 	github.com/0mlml/cfgparser v1.2.0
 	golang.org/x/crypto v0.15.0
 )
+
+require golang.org/x/sys v0.14.0 // indirect
@@ -4,45 +4,164 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 )
 
+// parseArgs splits command arguments into positional arguments and flags. Flags are written as
+// --name, --name=value or -n and are returned without their dashes.
+func parseArgs(parts []string) (args []string, flags map[string]string) {
+	flags = make(map[string]string)
+	for _, part := range parts {
+		switch {
+		case part == "":
+		case strings.HasPrefix(part, "--") && len(part) > 2:
+			key, value, _ := strings.Cut(part[2:], "=")
+			flags[key] = value
+		case strings.HasPrefix(part, "-") && len(part) > 1:
+			flags[part[1:]] = ""
+		default:
+			args = append(args, part)
+		}
+	}
+	return args, flags
+}
+
+func workerCount(flags map[string]string, configKey string) (int, error) {
+	workers := config.Int(configKey)
+	if value, ok := flags["workers"]; ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid worker count %q", value)
+		}
+		workers = n
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers, nil
+}
+
+// redactCommand returns a command as it is shown in error messages. The arguments of rekey are left
+// out, in case a key was typed there.
+func redactCommand(cmd string) string {
+	if name, _, found := strings.Cut(cmd, " "); found && name == "rekey" {
+		return name + " [redacted]"
+	}
+	return cmd
+}
+
 func handleCommand(cmd string) error {
 	parts := strings.Split(cmd, " ")
 
 	switch parts[0] {
+	case "list":
+		args, flags := parseArgs(parts[1:])
+		if len(args) > 1 {
+			return fmt.Errorf("invalid list command")
+		}
+
+		return onReplicaFlag(flags, func() error {
+			return listFiles(args, flags)
+		})
+	case "verify":
+		args, flags := parseArgs(parts[1:])
+		if len(args) != 1 {
+			return fmt.Errorf("invalid verify command")
+		}
+
+		return onReplicaFlag(flags, func() error {
+			return verifyFile(args[0], flags)
+		})
+	case "delete":
+		args, flags := parseArgs(parts[1:])
+		if len(args) != 1 {
+			return fmt.Errorf("invalid delete command")
+		}
+
+		return onReplicaFlag(flags, func() error {
+			return deleteFile(args[0])
+		})
+	case "rekey":
+		args, flags := parseArgs(parts[1:])
+		newKey, err := readNewKey(args, flags)
+		if err != nil {
+			return err
+		}
+
+		return rekeyReplicas(newKey, flags)
+	case "keygen":
+		_, flags := parseArgs(parts[1:])
+		return keygen(flags)
 	case "init":
 		intialize()
 	case "send":
-		if len(parts) != 2 {
+		args, flags := parseArgs(parts[1:])
+		if len(args) != 1 {
 			return fmt.Errorf("invalid send command")
 		}
-		cf, err := chunkFile(parts[1])
 
+		workers, err := workerCount(flags, "upload_workers")
 		if err != nil {
-			return fmt.Errorf("error chunking file: %v", err)
+			return err
 		}
 
-		logger.Printf("Chunked file %s into %d chunks\n", cf.name, len(cf.data))
-
-		return sendChunkedFile(cf)
+		_, resume := flags["resume"]
+		return sendReplicated(args[0], workers, resume, flags)
 	case "fetch":
-		if len(parts) != 2 {
+		args, flags := parseArgs(parts[1:])
+		if len(args) != 1 {
 			return fmt.Errorf("invalid fetch command")
 		}
 
-		cf, err := fetchChunkedFile(parts[1])
+		return onReplicaFlag(flags, func() error {
+			return fetchFile(args[0], flags)
+		})
+	}
 
-		if err != nil {
-			return fmt.Errorf("error fetching file: %v", err)
+	return nil
+}
+
+// sendPath sends a file, or a directory with -r, to the active backend.
+func sendPath(path string, workers int, resume bool, flags map[string]string) error {
+	_, recursive := flags["r"]
+	if stat, err := os.Stat(path); err == nil && stat.IsDir() {
+		if !recursive {
+			return fmt.Errorf("%s is a directory, use send -r to upload it", path)
 		}
 
-		logger.Printf("Decrypting and reconstructing file %s\n", cf.name)
+		return sendDirectory(path, workers, resume, flags)
+	}
 
-		return reconstructFile(cf, fmt.Sprintf("%s.dec", cf.name))
+	var cf *chunkedFile
+	var err error
+	if resume {
+		cf, err = resumeChunkedFile(path)
+	} else {
+		cf, err = chunkFile(path)
 	}
 
-	return nil
+	if err != nil {
+		return fmt.Errorf("error chunking file: %v", err)
+	}
+	defer cf.Close()
+
+	if ratio, ok := flags["parity"]; ok {
+		if err := applyParity(cf, ratio); err != nil {
+			return err
+		}
+	}
+
+	if list, ok := flags["recipients"]; ok {
+		if err := applyRecipients(cf, list); err != nil {
+			return err
+		}
+	}
+
+	logger.Printf("Streaming file %s in %d chunks\n", cf.name, cf.chunks)
+
+	_, err = sendChunkedFile(cf, workers)
+	return err
 }
 
 func simpleReadPump() {
@@ -58,7 +177,7 @@ func simpleReadPump() {
 		command = strings.TrimSpace(command)
 
 		if err := handleCommand(command); err != nil {
-			logger.Printf("Error handling command \"%s\": %v\n", command, err)
+			logger.Printf("Error handling command \"%s\": %v\n", redactCommand(command), err)
 		}
 	}
 }
@@ -138,6 +138,46 @@ func readInput() (string, error) {
 	}
 }
 
+// readPassword prompts for a line on the terminal without echoing it.
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+
+	oldState, err := enableRawMode(fd)
+	if err != nil {
+		return "", fmt.Errorf("can't read the key from the terminal, use --key-file or %s: %v", newKeyEnv, err)
+	}
+	defer disableRawMode(fd, oldState)
+
+	logger.Printf("%s", prompt)
+
+	var buf [1]byte
+	var line []byte
+	for {
+		n, err := syscall.Read(fd, buf[:])
+		if err != nil {
+			return "", err
+		}
+		if n <= 0 {
+			return "", fmt.Errorf("no key entered")
+		}
+
+		switch c := buf[0]; {
+		case c == '\n' || c == '\r':
+			logger.Printf("\n")
+			return string(line), nil
+		case c == '\x03':
+			logger.Printf("\n")
+			return "", fmt.Errorf("cancelled")
+		case c == 127:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+		default:
+			line = append(line, c)
+		}
+	}
+}
+
 func updateDisplay(b *strings.Builder, cursorPos int) {
 	logger.Printf("\033[2K\033[G")
 
@@ -156,7 +196,7 @@ func handleTabCompletion(parts []string) ([]string, error) {
 
 	switch len(parts) {
 	case 1:
-		for _, command := range []string{"init", "send", "fetch"} {
+		for _, command := range []string{"init", "send", "fetch", "list", "verify", "delete", "rekey", "keygen"} {
 			if strings.HasPrefix(command, search) {
 				options = append(options, command)
 			}
@@ -189,13 +229,15 @@ func handleTabCompletion(parts []string) ([]string, error) {
 			}
 
 			return options, nil
-		case "fetch":
+		case "fetch", "verify", "delete":
 			for _, id := range idHistory {
 				if strings.HasPrefix(id, search) {
 					options = append(options, id)
 				}
 			}
 
+			options = append(options, completeNames(search)...)
+
 			return options, nil
 		}
 	}
@@ -215,7 +257,7 @@ func advancedReadPump() {
 		command = strings.TrimSpace(command)
 
 		if err := handleCommand(command); err != nil {
-			logger.Printf("Error handling command \"%s\": %v\n", command, err)
+			logger.Printf("Error handling command \"%s\": %v\n", redactCommand(command), err)
 		}
 	}
 }
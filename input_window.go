@@ -3,6 +3,12 @@
 
 package main
 
+import "fmt"
+
 func advancedReadPump() {
 	panic("This message should never be seen")
 }
+
+func readPassword(prompt string) (string, error) {
+	return "", fmt.Errorf("can't read the key without echoing it here, use --key-file or %s", newKeyEnv)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// uploadJournal records every chunk confirmed by the backend so an interrupted send can continue
+// with the same salt and file ID instead of starting over. It is saved after every chunk.
+type uploadJournal struct {
+	Path          string     `json:"path"`
+	Size          int64      `json:"size"`
+	ModTime       time.Time  `json:"mod_time"`
+	Salt          []byte     `json:"salt"`
+	FileID        []byte     `json:"file_id"`
+	WrappedKey    []byte     `json:"wrapped_key,omitempty"`
+	Recipients    []string   `json:"recipients,omitempty"`
+	RecipientKeys [][]byte   `json:"recipient_keys,omitempty"`
+	KeyCheck      []byte     `json:"key_check"`
+	ChunkSize     int        `json:"chunk_size"`
+	Parallel      bool       `json:"parallel"`
+	Dedup         bool       `json:"dedup,omitempty"`
+	Chunker       string     `json:"chunker,omitempty"`
+	Compression   string     `json:"compression,omitempty"`
+	Chunks        []chunkRef `json:"chunks"`
+	ParityData    int        `json:"parity_data,omitempty"`
+	ParityShards  int        `json:"parity_shards,omitempty"`
+	Parity        []chunkRef `json:"parity,omitempty"`
+
+	file string
+	mu   sync.Mutex
+}
+
+func journalFile(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(absPath))
+	return filepath.Join(config.String("journal_dir"), replicaFile(hex.EncodeToString(sum[:8])+".json")), nil
+}
+
+func journalKeyCheck(key []byte, fileID []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("discord-fs journal"))
+	mac.Write(fileID)
+	return mac.Sum(nil)[:8]
+}
+
+func newJournal(path string, f *chunkedFile, parallel bool) (*uploadJournal, error) {
+	file, err := journalFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	j := &uploadJournal{
+		Path:          path,
+		Size:          f.size,
+		ModTime:       stat.ModTime(),
+		Salt:          f.salt,
+		FileID:        f.fileID,
+		WrappedKey:    f.wrappedKey,
+		Recipients:    f.recipients,
+		RecipientKeys: f.recipientKeys,
+		KeyCheck:      journalKeyCheck(f.key, f.fileID),
+		ChunkSize:     len(f.buffer),
+		Parallel:      parallel,
+		Dedup:         f.dedup,
+		Chunker:       f.chunker,
+		Compression:   f.compression,
+		Chunks:        make([]chunkRef, f.chunks),
+		file:          file,
+	}
+
+	if f.parityData > 0 {
+		j.ParityData = f.parityData
+		j.ParityShards = f.parityShards
+		j.Parity = make([]chunkRef, parityGroups(f)*f.parityShards)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return nil, err
+	}
+
+	return j, j.save()
+}
+
+func loadJournal(path string) (*uploadJournal, error) {
+	file, err := journalFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &uploadJournal{file: file}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("corrupt journal %s: %v", file, err)
+	}
+
+	return j, nil
+}
+
+// saveJSON replaces file atomically, so an interruption leaves either the old or the new state.
+func saveJSON(file string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+func (j *uploadJournal) save() error {
+	return saveJSON(j.file, j)
+}
+
+func (j *uploadJournal) record(n int, ref chunkRef) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Chunks[n] = ref
+	return j.save()
+}
+
+func (j *uploadJournal) recordParity(n int, ref chunkRef) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Parity[n] = ref
+	return j.save()
+}
+
+// parityDone reports whether every parity chunk of a group was uploaded.
+func (j *uploadJournal) parityDone(group int) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, ref := range j.Parity[group*j.ParityShards : (group+1)*j.ParityShards] {
+		if ref.Message == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (j *uploadJournal) confirmed() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	confirmed := 0
+	for _, ref := range j.Chunks {
+		if ref.Message != "" {
+			confirmed++
+		}
+	}
+	return confirmed
+}
+
+func (j *uploadJournal) remove() {
+	os.Remove(j.file)
+}
+
+// resumeChunkedFile reopens a file described by a journal, checking that neither the file nor the
+// key changed since the chunks in it were uploaded. The keys are taken from the journal, so resuming
+// doesn't derive a key for a new upload first.
+func resumeChunkedFile(path string) (*chunkedFile, error) {
+	j, err := loadJournal(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no unfinished upload of %s to resume", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := openChunkedFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.file.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if stat.Size() != j.Size || !stat.ModTime().Equal(j.ModTime) {
+		f.Close()
+		return nil, fmt.Errorf("%s changed since the upload was started, send it again without --resume", path)
+	}
+
+	if j.Chunker != "" && j.Chunker != f.chunker {
+		f.Close()
+		return nil, fmt.Errorf("chunker changed since the upload was started, set it back to %s to resume", j.Chunker)
+	}
+
+	if j.Compression != f.compression {
+		f.Close()
+		return nil, fmt.Errorf("compression changed since the upload was started, set it back to resume")
+	}
+
+	f.salt = j.Salt
+	f.fileID = j.FileID
+	f.wrappedKey = j.WrappedKey
+	f.recipients = j.Recipients
+	f.recipientKeys = j.RecipientKeys
+	if f.key, f.sharedKey, err = openFileKey(j.WrappedKey, cachedSaltedKey(config.String("your_key"), j.Salt), j.FileID); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("your_key changed since the upload was started, set it back to resume")
+	}
+
+	if !bytes.Equal(journalKeyCheck(f.key, f.fileID), j.KeyCheck) {
+		f.Close()
+		return nil, fmt.Errorf("your_key changed since the upload was started, set it back to resume")
+	}
+
+	f.dedup = j.Dedup
+	f.parityData = j.ParityData
+	f.parityShards = j.ParityShards
+	f.journal = j
+
+	if f.chunker == "fastcdc" {
+		if err := f.contentDefinedChunks(); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error finding chunk boundaries: %v", err)
+		}
+	}
+
+	if len(f.buffer) != j.ChunkSize || len(j.Chunks) != f.chunks {
+		f.Close()
+		return nil, fmt.Errorf("max_file_size or cdc_avg_size changed since the upload was started, set them back to resume")
+	}
+
+	return f, nil
+}
+
+// dirJournal records the files of a directory upload that are completely sent, so send -r --resume
+// skips them. Files that were only partly sent continue from their own upload journal.
+type dirJournal struct {
+	Root  string              `json:"root"`
+	Files map[string]dirEntry `json:"files"`
+
+	file string
+}
+
+func newDirJournal(root string) (*dirJournal, error) {
+	file, err := journalFile(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return nil, err
+	}
+
+	j := &dirJournal{Root: root, Files: make(map[string]dirEntry), file: file}
+
+	return j, j.save()
+}
+
+func loadDirJournal(root string) (*dirJournal, error) {
+	file, err := journalFile(root)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &dirJournal{file: file}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("corrupt journal %s: %v", file, err)
+	}
+	if j.Files == nil {
+		j.Files = make(map[string]dirEntry)
+	}
+
+	return j, nil
+}
+
+func (j *dirJournal) save() error {
+	return saveJSON(j.file, j)
+}
+
+func (j *dirJournal) record(member dirEntry) error {
+	j.Files[member.Path] = member
+	return j.save()
+}
+
+func (j *dirJournal) remove() {
+	os.Remove(j.file)
+}
+
+// downloadProgress records which chunks of a fetch are written to the output file and authenticated,
+// so an interrupted fetch can continue with only the missing chunks.
+type downloadProgress struct {
+	FileID []byte   `json:"file_id"`
+	Salt   []byte   `json:"salt"`
+	Size   int64    `json:"size"`
+	Done   []bool   `json:"done"`
+	Hashes [][]byte `json:"hashes,omitempty"`
+
+	file string
+	mu   sync.Mutex
+}
+
+func newDownloadProgress(f *chunkedFile, outputPath string, size int64) (*downloadProgress, error) {
+	p := &downloadProgress{
+		FileID: f.fileID,
+		Salt:   f.salt,
+		Size:   size,
+		Done:   make([]bool, len(f.messages)),
+		Hashes: f.hashes,
+		file:   outputPath + ".progress",
+	}
+
+	return p, p.save()
+}
+
+// loadDownloadProgress returns nil when there is no progress for this exact file to resume from.
+func loadDownloadProgress(f *chunkedFile, outputPath string, size int64) (*downloadProgress, error) {
+	data, err := os.ReadFile(outputPath + ".progress")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p := &downloadProgress{file: outputPath + ".progress"}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("corrupt progress file %s: %v", p.file, err)
+	}
+
+	sameFile := bytes.Equal(p.FileID, f.fileID) && bytes.Equal(p.Salt, f.salt)
+	if !(sameFile || sameChunks(p.Hashes, f.hashes)) || p.Size != size || len(p.Done) != len(f.messages) {
+		return nil, nil
+	}
+
+	if stat, err := os.Stat(outputPath); err != nil || stat.Size() != size {
+		return nil, nil
+	}
+
+	return p, nil
+}
+
+// sameChunks reports whether two uploads hold the same plaintext chunks, as copies of a file on
+// different replicas do when they were chunked the same way.
+func sameChunks(a [][]byte, b [][]byte) bool {
+	if len(a) == 0 || len(a) != len(b) {
+		return false
+	}
+
+	for n := range a {
+		if a[n] == nil || !bytes.Equal(a[n], b[n]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *downloadProgress) save() error {
+	return saveJSON(p.file, p)
+}
+
+func (p *downloadProgress) markDone(n int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.Done[n] = true
+	return p.save()
+}
+
+func (p *downloadProgress) done() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	done := 0
+	for _, d := range p.Done {
+		if d {
+			done++
+		}
+	}
+	return done
+}
+
+func (p *downloadProgress) remove() {
+	os.Remove(p.file)
+}
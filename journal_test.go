@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// countingBackend counts the chunks successfully downloaded through it.
+type countingBackend struct {
+	Backend
+	downloads int
+	mu        sync.Mutex
+}
+
+func (b *countingBackend) GetChunk(attachment discordAttachment) ([]byte, error) {
+	data, err := b.Backend.GetChunk(attachment)
+	if err == nil && attachment.Filename != indexFileName {
+		b.mu.Lock()
+		b.downloads++
+		b.mu.Unlock()
+	}
+
+	return data, err
+}
+
+// interruptFetch makes chunk n of name unreadable with damage, fetches the file to output with one
+// worker so it stops at that chunk, and undoes the damage.
+func interruptFetch(t *testing.T, name string, n int, output string, damage func(path string)) {
+	t.Helper()
+
+	path := attachmentPath(t, testIndex(t, name).Chunks[n])
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	damage(path)
+	if err := fetchFile(name, map[string]string{"output": output, "workers": "1"}); err == nil {
+		t.Fatalf("fetched %s with chunk %d damaged", name, n)
+	}
+
+	if err := os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchResume(t *testing.T) {
+	for damage, fn := range map[string]func(path string){
+		"removed": func(path string) {
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"truncated": func(path string) {
+			if err := os.Truncate(path, 10); err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		dir := setupTest(t)
+		config.SetInt("max_retry", 1)
+
+		path := filepath.Join(dir, "file.bin")
+		data := writeRandomFile(t, path, 20000)
+		sendTestFile(t, path, 1, nil)
+
+		output := filepath.Join(dir, "fetched")
+		interruptFetch(t, "file.bin", 2, output, fn)
+
+		var progress downloadProgress
+		if data, err := os.ReadFile(output + ".progress"); err != nil {
+			t.Fatalf("%s chunk: no progress recorded: %v", damage, err)
+		} else if err := json.Unmarshal(data, &progress); err != nil {
+			t.Fatal(err)
+		}
+		if !progress.Done[0] || !progress.Done[1] || progress.Done[2] {
+			t.Fatalf("%s chunk: progress is %v", damage, progress.Done)
+		}
+
+		counting := &countingBackend{Backend: backend}
+		backend = counting
+		if err := fetchFile("file.bin", map[string]string{"output": output, "resume": "", "workers": "1"}); err != nil {
+			t.Fatalf("%s chunk: resume: %v", damage, err)
+		}
+		backend = counting.Backend
+
+		// Only the chunks that weren't written are downloaded again.
+		missing := 0
+		for _, done := range progress.Done {
+			if !done {
+				missing++
+			}
+		}
+		if counting.downloads != missing {
+			t.Fatalf("%s chunk: resume downloaded %d chunks, %d were missing", damage, counting.downloads, missing)
+		}
+		if got, err := os.ReadFile(output); err != nil || string(got) != string(data) {
+			t.Fatalf("%s chunk: resumed file differs: %v", damage, err)
+		}
+		if _, err := os.Stat(output + ".progress"); !os.IsNotExist(err) {
+			t.Fatalf("%s chunk: progress left behind after the fetch finished: %v", damage, err)
+		}
+	}
+}
+
+func TestFetchResumeDamagedOutput(t *testing.T) {
+	dir := setupTest(t)
+	config.SetInt("max_retry", 1)
+
+	path := filepath.Join(dir, "file.bin")
+	data := writeRandomFile(t, path, 20000)
+	sendTestFile(t, path, 1, nil)
+
+	removeChunk := func(path string) { os.Remove(path) }
+
+	// A truncated output file can't be trusted, so the fetch starts over instead of resuming.
+	output := filepath.Join(dir, "truncated")
+	interruptFetch(t, "file.bin", 2, output, removeChunk)
+	if err := os.Truncate(output, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetchFile("file.bin", map[string]string{"output": output, "resume": ""}); err == nil {
+		t.Fatal("resumed into a truncated output file")
+	}
+	if err := fetchFile("file.bin", map[string]string{"output": output, "resume": "", "force": ""}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(output); string(got) != string(data) {
+		t.Fatal("refetched file differs")
+	}
+
+	// Without the output file there is nothing to resume.
+	output = filepath.Join(dir, "removed")
+	interruptFetch(t, "file.bin", 2, output, removeChunk)
+	if err := os.Remove(output); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetchFile("file.bin", map[string]string{"output": output, "resume": ""}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(output); string(got) != string(data) {
+		t.Fatal("refetched file differs")
+	}
+
+	// Chunks written before the interruption and changed since fail the whole file hash.
+	output = filepath.Join(dir, "changed")
+	interruptFetch(t, "file.bin", 2, output, removeChunk)
+	file, err := os.OpenFile(output, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("changed"), 10)
+	file.Close()
+	if err := fetchFile("file.bin", map[string]string{"output": output, "resume": ""}); err == nil {
+		t.Fatal("resumed into an output file whose written chunks changed")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const discordEpoch = 1420070400000
+
+// localBackend stores channels as directories and messages as JSON files next to their attachments,
+// so the full send/fetch round trip can run offline and without a bot token.
+type localBackend struct {
+	root              string
+	manfiestChannelID string
+	dataChannels      []string
+
+	mu            sync.Mutex
+	lastTimestamp int64
+	sequence      int64
+}
+
+func newLocalBackend(root string) (*localBackend, error) {
+	if root == "" {
+		return nil, fmt.Errorf("local_path is empty")
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(absRoot, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &localBackend{root: absRoot}, nil
+}
+
+func (b *localBackend) Init() error {
+	if err := os.MkdirAll(filepath.Join(b.root, "manifest"), 0o755); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(b.root)
+	if err != nil {
+		return err
+	}
+
+	b.manfiestChannelID = "manifest"
+	b.dataChannels = nil
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "data") {
+			b.dataChannels = append(b.dataChannels, entry.Name())
+		}
+	}
+
+	if len(b.dataChannels) == 0 {
+		logger.Printf("Data channel not found, creating...\n")
+		if err := os.MkdirAll(filepath.Join(b.root, "data0"), 0o755); err != nil {
+			return err
+		}
+		b.dataChannels = []string{"data0"}
+	}
+
+	return nil
+}
+
+func (b *localBackend) ManifestChannel() string {
+	return b.manfiestChannelID
+}
+
+func (b *localBackend) DataChannels() []string {
+	return b.dataChannels
+}
+
+func (b *localBackend) nextID() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	timestamp := time.Now().UnixMilli() - discordEpoch
+	if timestamp <= b.lastTimestamp {
+		timestamp = b.lastTimestamp
+		b.sequence++
+	} else {
+		b.lastTimestamp = timestamp
+		b.sequence = 0
+	}
+
+	return strconv.FormatInt(timestamp<<22|b.sequence, 10)
+}
+
+func (b *localBackend) channelPath(channelID string) (string, error) {
+	if channelID == "" || strings.ContainsAny(channelID, `/\`) || channelID == "." || channelID == ".." {
+		return "", fmt.Errorf("invalid channel %q", channelID)
+	}
+	return filepath.Join(b.root, channelID), nil
+}
+
+func (b *localBackend) messagePath(channelID string, messageID string) (string, error) {
+	channelPath, err := b.channelPath(channelID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := strconv.ParseUint(messageID, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid message ID %q", messageID)
+	}
+	return filepath.Join(channelPath, messageID+".json"), nil
+}
+
+func (b *localBackend) PutChunk(message messageCreate) (string, error) {
+	channelPath, err := b.channelPath(message.ChannelID)
+	if err != nil {
+		return "", err
+	}
+
+	stored := discordMessage{
+		ID:        b.nextID(),
+		ChannelID: message.ChannelID,
+		Content:   message.Content,
+	}
+	stored.Reference.MessageID = message.ReferenceID
+
+	if message.Data != nil {
+		attachmentPath := filepath.Join(channelPath, stored.ID+"-"+filepath.Base(message.FileName))
+		if err := os.WriteFile(attachmentPath, message.Data, 0o644); err != nil {
+			return "", err
+		}
+
+		stored.Attachments = []discordAttachment{{
+			Filename: message.FileName,
+			Size:     len(message.Data),
+			URL:      (&url.URL{Scheme: "file", Path: filepath.ToSlash(attachmentPath)}).String(),
+		}}
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(filepath.Join(channelPath, stored.ID+".json"), data, 0o644); err != nil {
+		return "", err
+	}
+
+	return stored.ID, nil
+}
+
+func (b *localBackend) PutManifest(message messageCreate) (string, error) {
+	message.ChannelID = b.manfiestChannelID
+	return b.PutChunk(message)
+}
+
+func (b *localBackend) EditMessage(channelID string, messageID string, content string) error {
+	message, err := b.GetMessage(channelID, messageID)
+	if err != nil {
+		return err
+	}
+
+	message.Content = content
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	messagePath, _ := b.messagePath(channelID, messageID)
+	return os.WriteFile(messagePath, data, 0o644)
+}
+
+func (b *localBackend) GetChunk(attachment discordAttachment) ([]byte, error) {
+	u, err := url.Parse(attachment.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "file" {
+		return nil, fmt.Errorf("unsupported attachment URL %s", attachment.URL)
+	}
+
+	data, err := os.ReadFile(filepath.FromSlash(u.Path))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("attachment %s: %w", attachment.Filename, errNotFound)
+	}
+
+	return data, err
+}
+
+func (b *localBackend) GetMessage(channelID string, messageID string) (*discordMessage, error) {
+	messagePath, err := b.messagePath(channelID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(messagePath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("message %s in channel %s: %w", messageID, channelID, errNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var message discordMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+func snowflakeLess(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func (b *localBackend) ListManifest(before string, after string, limit int) ([]*discordMessage, error) {
+	entries, err := os.ReadDir(filepath.Join(b.root, b.manfiestChannelID))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if before != "" && !snowflakeLess(id, before) {
+			continue
+		}
+		if after != "" && !snowflakeLess(after, id) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return snowflakeLess(ids[j], ids[i]) })
+
+	if len(ids) > limit {
+		if after != "" && before == "" {
+			ids = ids[len(ids)-limit:]
+		} else {
+			ids = ids[:limit]
+		}
+	}
+
+	messages := make([]*discordMessage, 0, len(ids))
+	for _, id := range ids {
+		message, err := b.GetMessage(b.manfiestChannelID, id)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+func (b *localBackend) Delete(channelID string, messageIDs []string) error {
+	for _, messageID := range messageIDs {
+		message, err := b.GetMessage(channelID, messageID)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				continue
+			}
+			return err
+		}
+
+		for _, attachment := range message.Attachments {
+			if u, err := url.Parse(attachment.URL); err == nil && u.Scheme == "file" {
+				os.Remove(filepath.FromSlash(u.Path))
+			}
+		}
+
+		messagePath, _ := b.messagePath(channelID, messageID)
+		if err := os.Remove(messagePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/0mlml/cfgparser"
+)
+
+// setupTest points the config at a fresh local server in a temporary directory. Keys are derived with
+// cheap PBKDF2 parameters and attachments are small, so files of a few chunks stay quick to send.
+func setupTest(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	cfgparser.SetDefaultConfig(newDefaultConfig())
+	config = &cfgparser.Config{}
+	config.Default()
+	config.SetBool("advanced_terminal", false)
+	config.SetString("backend", "local")
+	config.SetString("local_path", filepath.Join(dir, "server"))
+	config.SetString("journal_dir", filepath.Join(dir, "journal"))
+	config.SetString("chunk_index", filepath.Join(dir, "chunks.json"))
+	config.SetString("key_salt", filepath.Join(dir, "salt.json"))
+	config.SetString("identity", filepath.Join(dir, "identity.key"))
+	config.SetString("your_key", "test key")
+	config.SetString("kdf", "pbkdf2")
+	config.SetInt("pbkdf2_iterations", 1000)
+	config.SetInt("max_file_size", 4096)
+
+	path := *configPath
+	*configPath = filepath.Join(dir, "discord-fs.cfg")
+	t.Cleanup(func() { *configPath = path })
+
+	var err error
+	if replicas, err = newReplicas(); err != nil {
+		t.Fatal(err)
+	}
+	backend = replicas[0].backend
+	if err := backend.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	sharedChunks, activeReplica = nil, nil
+	identity, identityErr, identityLoaded = nil, nil, false
+
+	return dir
+}
+
+func writeRandomFile(t *testing.T, path string, size int) []byte {
+	t.Helper()
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func sendTestFile(t *testing.T, path string, workers int, flags map[string]string) {
+	t.Helper()
+
+	if flags == nil {
+		flags = map[string]string{}
+	}
+	if err := sendPath(path, workers, false, flags); err != nil {
+		t.Fatalf("send %s: %v", path, err)
+	}
+}
+
+// fetchTestFile fetches query to a new file and checks it holds want.
+func fetchTestFile(t *testing.T, query string, want []byte) {
+	t.Helper()
+
+	output := filepath.Join(t.TempDir(), "fetched")
+	if err := fetchFile(query, map[string]string{"output": output}); err != nil {
+		t.Fatalf("fetch %s: %v", query, err)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("fetch %s: got %d bytes that differ from the %d sent", query, len(got), len(want))
+	}
+}
+
+func testEntry(t *testing.T, name string) *manifestEntry {
+	t.Helper()
+
+	versions, err := resolveFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return versions[0]
+}
+
+func testIndex(t *testing.T, name string) *fileIndex {
+	t.Helper()
+
+	index, err := readFileIndex(testEntry(t, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return index
+}
+
+// failingBackend accepts a number of chunks and then fails every upload, like a connection that drops
+// in the middle of a send.
+type failingBackend struct {
+	Backend
+	left int
+	mu   sync.Mutex
+}
+
+func (b *failingBackend) PutChunk(message messageCreate) (string, error) {
+	b.mu.Lock()
+	if b.left == 0 {
+		b.mu.Unlock()
+		return "", errors.New("connection lost")
+	}
+	b.left--
+	b.mu.Unlock()
+
+	return b.Backend.PutChunk(message)
+}
+
+func TestSendFetchChain(t *testing.T) {
+	dir := setupTest(t)
+
+	path := filepath.Join(dir, "chain.bin")
+	data := writeRandomFile(t, path, 20000)
+	sendTestFile(t, path, 1, nil)
+
+	fetchTestFile(t, "chain.bin", data)
+	fetchTestFile(t, testEntry(t, "chain.bin").reference, data)
+}
+
+func TestSendFetchParallel(t *testing.T) {
+	dir := setupTest(t)
+
+	path := filepath.Join(dir, "parallel.bin")
+	data := writeRandomFile(t, path, 30000)
+	sendTestFile(t, path, 4, nil)
+
+	if index := testIndex(t, "parallel.bin"); len(index.Chunks) != testEntry(t, "parallel.bin").chunks {
+		t.Fatalf("index lists %d chunks", len(index.Chunks))
+	}
+
+	fetchTestFile(t, "parallel.bin", data)
+}
+
+func TestSendFetchEmpty(t *testing.T) {
+	dir := setupTest(t)
+
+	path := filepath.Join(dir, "empty.bin")
+	data := writeRandomFile(t, path, 0)
+	sendTestFile(t, path, 1, nil)
+
+	fetchTestFile(t, "empty.bin", data)
+}
+
+func TestSendResume(t *testing.T) {
+	for _, workers := range []int{1, 3} {
+		dir := setupTest(t)
+		local := backend
+
+		path := filepath.Join(dir, "resumed.bin")
+		data := writeRandomFile(t, path, 30000)
+
+		backend = &failingBackend{Backend: local, left: 3}
+		cf, err := chunkFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sendChunkedFile(cf, workers); err == nil {
+			t.Fatalf("%d workers: send succeeded with a failing backend", workers)
+		}
+		cf.Close()
+
+		backend = local
+		if err := sendPath(path, workers, true, map[string]string{}); err != nil {
+			t.Fatalf("%d workers: resume: %v", workers, err)
+		}
+
+		if _, err := loadJournal(path); !os.IsNotExist(err) {
+			t.Fatalf("%d workers: journal left behind after the upload finished: %v", workers, err)
+		}
+
+		fetchTestFile(t, "resumed.bin", data)
+	}
+}
+
+func TestResumeWithOtherKey(t *testing.T) {
+	dir := setupTest(t)
+	local := backend
+
+	path := filepath.Join(dir, "resumed.bin")
+	writeRandomFile(t, path, 30000)
+
+	backend = &failingBackend{Backend: local, left: 2}
+	cf, err := chunkFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sendChunkedFile(cf, 2); err == nil {
+		t.Fatal("send succeeded with a failing backend")
+	}
+	cf.Close()
+	backend = local
+
+	config.SetString("your_key", "another key")
+	if _, err := resumeChunkedFile(path); err == nil {
+		t.Fatal("resumed an upload under a different key")
+	}
+}
+
+func TestDedupCDCGzip(t *testing.T) {
+	dir := setupTest(t)
+	config.SetBool("dedup", true)
+	config.SetString("chunker", "fastcdc")
+	config.SetString("compression", "gzip")
+
+	// Text-like content, so gzip has something to do.
+	original := []byte("the quick brown fox jumps over the lazy dog ")
+	var content []byte
+	for i := 0; len(content) < 60000; i++ {
+		content = append(content, original...)
+		content = append(content, byte('a'+i%26), byte('a'+i/26%26), '\n')
+	}
+
+	first := filepath.Join(dir, "first.txt")
+	if err := os.WriteFile(first, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sendTestFile(t, first, 2, nil)
+
+	edited := append(append(append([]byte{}, content[:30000]...), []byte("an edit in the middle")...), content[30000:]...)
+	second := filepath.Join(dir, "second.txt")
+	if err := os.WriteFile(second, edited, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sendTestFile(t, second, 2, nil)
+
+	if compression := testEntry(t, "first.txt").compression; compression != "gzip" {
+		t.Fatalf("text file sent with compression %q", compression)
+	}
+
+	firstIndex, secondIndex := testIndex(t, "first.txt"), testIndex(t, "second.txt")
+
+	reused := make(map[string]bool)
+	for _, ref := range firstIndex.Chunks {
+		if ref.Address == nil {
+			t.Fatal("chunk sent with dedup has no address")
+		}
+		reused[ref.Message] = true
+	}
+
+	shared := 0
+	for _, ref := range secondIndex.Chunks {
+		if reused[ref.Message] {
+			shared++
+		}
+	}
+	if shared < len(secondIndex.Chunks)-3 {
+		t.Fatalf("only %d of %d chunks were reused after a small edit", shared, len(secondIndex.Chunks))
+	}
+
+	fetchTestFile(t, "first.txt", content)
+	fetchTestFile(t, "second.txt", edited)
+
+	// A lost chunk index is rebuilt with the same shared chunk key, so chunks keep being reused.
+	key := sharedChunks.Key
+	sharedChunks = nil
+	if err := os.Remove(config.String("chunk_index")); err != nil {
+		t.Fatal(err)
+	}
+
+	third := filepath.Join(dir, "third.txt")
+	if err := os.WriteFile(third, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sendTestFile(t, third, 2, nil)
+
+	if !bytes.Equal(sharedChunks.Key, key) {
+		t.Fatal("rebuilt chunk index has a different shared chunk key")
+	}
+	for _, ref := range testIndex(t, "third.txt").Chunks {
+		if !reused[ref.Message] {
+			t.Fatal("identical file uploaded chunks again after the chunk index was rebuilt")
+		}
+	}
+}
+
+func TestCDCWithoutDedup(t *testing.T) {
+	dir := setupTest(t)
+	config.SetString("chunker", "fastcdc")
+
+	path := filepath.Join(dir, "file.bin")
+	data := writeRandomFile(t, path, 40000)
+	sendTestFile(t, path, 2, nil)
+	fetchTestFile(t, "file.bin", data)
+
+	if _, err := os.Stat(config.String("chunk_index")); !os.IsNotExist(err) {
+		t.Fatal("chunk index loaded without dedup")
+	}
+
+	// Boundaries are keyed with the data key, which every upload has its own of.
+	a, err := chunkFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := chunkFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if slices.Equal(a.cuts, b.cuts) {
+		t.Fatal("two uploads of a file were cut the same way")
+	}
+
+	// Sharing a file turns dedup off, and the boundaries are found again with the data key.
+	config.SetBool("dedup", true)
+	c, err := chunkFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	recipient, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyRecipients(c, encodePublicKey(recipient.PublicKey())); err != nil {
+		t.Fatal(err)
+	}
+
+	chunker, err := newCDCChunker(c.key, config.Int("cdc_avg_size"), len(c.buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.dedup || !slices.Equal(c.cuts, testCuts(t, chunker, data)) {
+		t.Fatal("boundaries weren't keyed with the data key after dedup was turned off")
+	}
+}
+
+func TestParityRebuildsDeletedChunks(t *testing.T) {
+	dir := setupTest(t)
+	config.SetString("parity", "2:1")
+
+	path := filepath.Join(dir, "parity.bin")
+	data := writeRandomFile(t, path, 25000)
+	sendTestFile(t, path, 2, nil)
+
+	index := testIndex(t, "parity.bin")
+	if len(index.Parity) != (len(index.Chunks)+1)/2 {
+		t.Fatalf("%d chunks got %d parity chunks", len(index.Chunks), len(index.Parity))
+	}
+
+	// One chunk of every group can go.
+	for n := 0; n < len(index.Chunks); n += 2 {
+		ref := index.Chunks[n]
+		if err := backend.Delete(ref.Channel, []string{ref.Message}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fetchTestFile(t, "parity.bin", data)
+
+	// Two chunks of a group are more than one parity chunk can rebuild.
+	ref := index.Chunks[1]
+	if err := backend.Delete(ref.Channel, []string{ref.Message}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetchFile("parity.bin", map[string]string{"output": filepath.Join(dir, "lost")}); err == nil {
+		t.Fatal("fetched a file that lost more chunks than its parity covers")
+	}
+}
+
+// sendLegacyChain posts a reply chain the way files were sent before chunks were authenticated: a
+// plaintext meta and AES-CFB chunks prefixed with their IV twice. It returns the chain-end reference.
+func sendLegacyChain(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	salt := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		t.Fatal(err)
+	}
+	key := deriveSaltedKey(config.String("your_key"), salt)
+	meta := base64.StdEncoding.EncodeToString([]byte(name + "\u0000" + base64.StdEncoding.EncodeToString(salt)))
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunkSize := 1000
+	lastMessageID := ""
+	for n := 0; n*chunkSize < len(data); n++ {
+		chunk := data[n*chunkSize : min(len(data), (n+1)*chunkSize)]
+
+		ciphertext := make([]byte, aes.BlockSize+len(chunk))
+		iv := ciphertext[:aes.BlockSize]
+		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+			t.Fatal(err)
+		}
+		cipher.NewCFBEncrypter(block, iv).XORKeyStream(ciphertext[aes.BlockSize:], chunk)
+
+		message := messageCreate{
+			ChannelID:   backend.DataChannels()[0],
+			ReferenceID: lastMessageID,
+			Data:        append(append([]byte{}, iv...), ciphertext...),
+			FileName:    "chunk.enc",
+		}
+		if n == 0 {
+			message.Content = meta
+		}
+
+		if lastMessageID, err = backend.PutChunk(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := backend.PutManifest(messageCreate{Content: formatManifestEntry(meta, lastMessageID)}); err != nil {
+		t.Fatal(err)
+	}
+
+	return lastMessageID
+}
+
+func TestLegacyCFBChain(t *testing.T) {
+	setupTest(t)
+
+	data := make([]byte, 3500)
+	io.ReadFull(rand.Reader, data)
+	reference := sendLegacyChain(t, "legacy.bin", data)
+
+	fetchTestFile(t, reference, data)
+	fetchTestFile(t, "legacy.bin", data)
+
+	if entry := testEntry(t, "legacy.bin"); entry.size != -1 || entry.chunks != -1 {
+		t.Fatalf("plaintext meta reports size %d and %d chunks", entry.size, entry.chunks)
+	}
+}
+
+// attachmentPath returns where the local backend keeps the attachment of a chunk.
+func attachmentPath(t *testing.T, ref chunkRef) string {
+	t.Helper()
+
+	message, err := backend.GetMessage(ref.Channel, ref.Message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(message.Attachments[0].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.FromSlash(u.Path)
+}
+
+func TestFetchRestoresPermissions(t *testing.T) {
+	dir := setupTest(t)
+
+	path := filepath.Join(dir, "tool")
+	data := writeRandomFile(t, path, 3000)
+	sendTestFile(t, path, 1, nil)
+
+	// Whoever shared the file wrote its meta and can ask for any mode.
+	entry := testEntry(t, "tool")
+	meta, err := parseMeta(entry.meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.Mode = uint32(0o750 | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	edited, err := generateMeta(meta, meta.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.EditMessage(backend.ManifestChannel(), entry.messageID, formatManifestEntry(edited, entry.reference)); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "fetched")
+	if err := fetchFile("tool", map[string]string{"output": output}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(output); !bytes.Equal(got, data) {
+		t.Fatal("fetched file differs")
+	}
+
+	// Permissions come back, but not the setuid, setgid and sticky bits.
+	if stat, err := os.Stat(output); err != nil {
+		t.Fatal(err)
+	} else if stat.Mode() != 0o750 {
+		t.Fatalf("fetched file has mode %v", stat.Mode())
+	}
+}
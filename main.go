@@ -13,38 +13,70 @@ var (
 	logger     = NewLogger()
 )
 
-func main() {
-	flag.Parse()
-
+// newDefaultConfig returns the options a config file can set, with their default values.
+func newDefaultConfig() *cfgparser.Config {
 	defaultConfig := &cfgparser.Config{}
 	defaultConfig.Literal(
 		map[string]bool{
 			"advanced_terminal": true,
+			"dedup":             false,
 		},
 		map[string]string{
+			"backend":       "discord",
+			"local_path":    "discord-fs-local",
+			"journal_dir":   "discord-fs-journal",
+			"chunk_index":   "discord-fs-chunks.json",
+			"key_salt":      "discord-fs-salt.json",
+			"chunker":       "fixed",
+			"compression":   "none",
+			"parity":        "none",
+			"kdf":           "argon2id",
+			"replicas":      "none",
+			"recipients":    "none",
+			"identity":      "discord-fs-identity.key",
 			"discord_token": "YOUR_TOKEN # Generate a token here: https://discord.com/developers/applications",
 			"server_id":     "111111111111111111 # The server to generate files in",
 			"your_key":      "YOUR_KEY # The key to encrypt files with",
 		},
 		map[string]int{
-			"max_file_size": 24214400, // This is arbitary, I just lowered it from 25MB until it worked
-			"max_retry":     5,
+			"max_file_size":     24214400, // This is arbitary, I just lowered it from 25MB until it worked
+			"max_retry":         5,
+			"upload_workers":    1,
+			"download_workers":  4,
+			"cdc_avg_size":      0,
+			"replication":       1,
+			"argon2_time":       3,
+			"argon2_memory":     64 * 1024,
+			"argon2_threads":    4,
+			"scrypt_log_n":      15,
+			"scrypt_r":          8,
+			"scrypt_p":          1,
+			"pbkdf2_iterations": 600000,
 		},
 		map[string]float64{},
 	)
 
-	cfgparser.SetDefaultConfig(defaultConfig)
+	return defaultConfig
+}
+
+func main() {
+	flag.Parse()
+
+	cfgparser.SetDefaultConfig(newDefaultConfig())
 
 	config = &cfgparser.Config{}
+	config.Default()
 	if err := config.From(*configPath); err != nil {
 		logger.Printf("Error parsing config file: %v", err)
 		return
 	}
 
-	if !setToken(config.String("discord_token")) {
-		logger.Printf("Error setting token")
+	var err error
+	if replicas, err = newReplicas(); err != nil {
+		logger.Printf("Error setting up backend: %v\n", err)
 		return
 	}
+	backend = replicas[0].backend
 
 	intialize()
 
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var errNotEntry = errors.New("not a manifest entry")
+
+const (
+	manifestPageSize   = 100
+	indexFileName      = "index.enc"
+	indexChunkNumber   = -1
+	maxMessageLength   = 2000
+	maxReferenceLength = 20
+)
+
+type manifestEntry struct {
+	messageID   string
+	meta        string
+	reference   string
+	name        string
+	salt        []byte
+	fileID      []byte
+	key         []byte
+	sharedKey   []byte
+	viaIdentity bool
+	size        int64
+	chunks      int
+	uploaded    time.Time
+	index       *discordAttachment
+	mode        os.FileMode
+	modTime     time.Time
+	dir         bool
+	compression string
+}
+
+type chunkRef struct {
+	Channel string `json:"channel"`
+	Message string `json:"message"`
+	Size    int    `json:"size"`
+	Hash    []byte `json:"hash,omitempty"`
+	Address []byte `json:"address,omitempty"`
+	Length  int64  `json:"length,omitempty"`
+}
+
+// fileIndex records where every chunk of a file was sent, in order. It is attached to the manifest
+// message encrypted like a chunk, so uploads without reply links can still be reassembled. The hashes
+// are SHA-256 of the plaintext chunks and of the whole file, checked after fetching. Chunks with an
+// address are shared chunks, which may also belong to other files. Length is the size of the
+// plaintext chunk, which can't be told from the attachment size when the file is compressed. Files
+// sent with parity have ParityShards parity chunks for every ParityData chunks, group after group.
+type fileIndex struct {
+	Chunks       []chunkRef `json:"chunks"`
+	Hash         []byte     `json:"hash,omitempty"`
+	ParityData   int        `json:"parity_data,omitempty"`
+	ParityShards int        `json:"parity_shards,omitempty"`
+	Parity       []chunkRef `json:"parity,omitempty"`
+}
+
+func sealIndex(index *fileIndex, key []byte, fileID []byte) ([]byte, error) {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	return sealChunk(data, key, fileID, indexChunkNumber, true)
+}
+
+func openIndex(sealed []byte, key []byte, fileID []byte) (*fileIndex, error) {
+	data, err := openChunk(sealed, key, fileID, indexChunkNumber, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var index fileIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+
+	return &index, nil
+}
+
+func snowflakeTime(id string) time.Time {
+	snowflake, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(int64(snowflake>>22) + discordEpoch)
+}
+
+// formatManifestEntry lays out a manifest message as the meta and the chain-end reference. The size
+// and chunk count are sealed in the meta.
+func formatManifestEntry(meta string, reference string) string {
+	return fmt.Sprintf("%s\n%s", meta, reference)
+}
+
+// checkManifestEntry makes sure the manifest entry of a meta fits in a Discord message whatever its
+// reference turns out to be, so a send doesn't fail after every chunk was uploaded.
+func checkManifestEntry(meta string) error {
+	if n := len(formatManifestEntry(meta, strings.Repeat("0", maxReferenceLength))); n > maxMessageLength {
+		return fmt.Errorf("metadata takes %d characters, more than the %d a Discord message can hold; use a shorter path or fewer recipients", n, maxMessageLength)
+	}
+
+	return nil
+}
+
+func parseManifestEntry(message *discordMessage) (*manifestEntry, error) {
+	lines := strings.Split(message.Content, "\n")
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("manifest message %s: %w", message.ID, errNotEntry)
+	}
+
+	meta, err := parseMeta(lines[0])
+	if err != nil {
+		return nil, fmt.Errorf("manifest message %s: %v", message.ID, err)
+	}
+
+	entry := &manifestEntry{
+		messageID:   message.ID,
+		meta:        lines[0],
+		reference:   lines[1],
+		name:        meta.Name,
+		salt:        meta.salt,
+		fileID:      meta.fileID,
+		key:         meta.key,
+		sharedKey:   meta.sharedKey,
+		viaIdentity: meta.viaIdentity,
+		size:        meta.Size,
+		chunks:      meta.Chunks,
+		uploaded:    snowflakeTime(message.ID),
+		mode:        os.FileMode(meta.Mode),
+		dir:         meta.Dir,
+		compression: meta.Compression,
+	}
+
+	if meta.ModTime != 0 {
+		entry.modTime = time.Unix(0, meta.ModTime)
+	}
+
+	for i := range message.Attachments {
+		if message.Attachments[i].Filename == indexFileName && entry.fileID != nil {
+			entry.index = &message.Attachments[i]
+		}
+	}
+
+	return entry, nil
+}
+
+// walkManifest pages through the manifest channel, newest first unless only after is given, and calls
+// fn for every entry until it returns false. Messages that are not entries are skipped. So are entries
+// that can't be opened with your_key or the identity, which are counted in unreadable.
+func walkManifest(before string, after string, fn func(entry *manifestEntry) bool) (unreadable int, err error) {
+	forward := after != "" && before == ""
+
+	for {
+		var messages []*discordMessage
+		if forward {
+			messages, err = backend.ListManifest("", after, manifestPageSize)
+		} else {
+			messages, err = backend.ListManifest(before, "", manifestPageSize)
+		}
+		if err != nil {
+			return unreadable, err
+		}
+
+		if len(messages) == 0 {
+			return unreadable, nil
+		}
+
+		for i := range messages {
+			message := messages[i]
+			if forward {
+				message = messages[len(messages)-1-i]
+			}
+
+			if after != "" && !forward && !snowflakeLess(after, message.ID) {
+				return unreadable, nil
+			}
+
+			entry, err := parseManifestEntry(message)
+			if err != nil {
+				if !errors.Is(err, errNotEntry) {
+					unreadable++
+				}
+				continue
+			}
+
+			rememberName(entry.name)
+
+			if !fn(entry) {
+				return unreadable, nil
+			}
+		}
+
+		if forward {
+			after = messages[0].ID
+		} else {
+			before = messages[len(messages)-1].ID
+		}
+
+		if len(messages) < manifestPageSize {
+			return unreadable, nil
+		}
+	}
+}
+
+func formatSize(size int64) string {
+	if size < 0 {
+		return "?"
+	}
+
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// listEntries returns the manifest entries matching the glob in args, in the order flags ask for, and
+// how many entries couldn't be opened.
+func listEntries(args []string, flags map[string]string) ([]*manifestEntry, int, error) {
+	pattern := "*"
+	if len(args) > 0 {
+		pattern = args[0]
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, 0, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+
+	var entries []*manifestEntry
+	unreadable, err := walkManifest(flags["before"], flags["after"], func(entry *manifestEntry) bool {
+		nameMatch, _ := path.Match(pattern, entry.name)
+		baseMatch, _ := path.Match(pattern, path.Base(entry.name))
+		if nameMatch || baseMatch {
+			entries = append(entries, entry)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("error listing manifest: %v", err)
+	}
+
+	switch flags["sort"] {
+	case "", "date":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].uploaded.After(entries[j].uploaded) })
+	case "name":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	case "size":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].size > entries[j].size })
+	case "chunks":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].chunks > entries[j].chunks })
+	default:
+		return nil, 0, fmt.Errorf("unknown sort %q, expected date, name, size or chunks", flags["sort"])
+	}
+
+	if _, ok := flags["reverse"]; ok {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+
+	return entries, unreadable, nil
+}
+
+// listFiles prints the catalogue. The manifest ID is the reference fetch, verify and delete take; it
+// names the manifest message rather than the last chunk of the file.
+func listFiles(args []string, flags map[string]string) error {
+	entries, unreadable, err := listEntries(args, flags)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tCHUNKS\tUPLOADED\tMANIFEST ID")
+	for _, entry := range entries {
+		chunks := "?"
+		if entry.chunks >= 0 {
+			chunks = strconv.Itoa(entry.chunks)
+		}
+		name := entry.name
+		if entry.dir {
+			name += "/"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, formatSize(entry.size), chunks, entry.uploaded.Local().Format("2006-01-02 15:04"), entry.messageID)
+	}
+	w.Flush()
+
+	logger.Printf("%s%d files\n", b.String(), len(entries))
+	if unreadable > 0 {
+		logger.Printf("%d manifest entries could not be opened with your_key or your identity\n", unreadable)
+	}
+
+	return nil
+}
+
+var (
+	manifestNamesMu     sync.Mutex
+	manifestNames       = make(map[string]bool)
+	manifestNamesLoaded bool
+)
+
+func rememberName(name string) {
+	manifestNamesMu.Lock()
+	defer manifestNamesMu.Unlock()
+
+	manifestNames[name] = true
+}
+
+// completeNames returns known file names starting with prefix, reading the whole manifest the first time.
+func completeNames(prefix string) []string {
+	manifestNamesMu.Lock()
+	loaded := manifestNamesLoaded
+	manifestNamesMu.Unlock()
+
+	if !loaded {
+		if _, err := walkManifest("", "", func(entry *manifestEntry) bool { return true }); err != nil {
+			return nil
+		}
+
+		manifestNamesMu.Lock()
+		manifestNamesLoaded = true
+		manifestNamesMu.Unlock()
+	}
+
+	manifestNamesMu.Lock()
+	defer manifestNamesMu.Unlock()
+
+	var names []string
+	for name := range manifestNames {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func isSnowflake(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
+
+// resolveFile finds every version of a file stored under name, newest first. A bare base name
+// matches files that were sent from another directory.
+func resolveFile(name string) ([]*manifestEntry, error) {
+	want := normalizePath(filepath.FromSlash(name))
+
+	var exact, base []*manifestEntry
+	unreadable, err := walkManifest("", "", func(entry *manifestEntry) bool {
+		if entry.name == name || normalizePath(filepath.FromSlash(entry.name)) == want {
+			exact = append(exact, entry)
+		} else if path.Base(entry.name) == name {
+			base = append(base, entry)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %v", err)
+	}
+
+	if len(exact) > 0 {
+		return exact, nil
+	}
+
+	if len(base) > 0 {
+		return base, nil
+	}
+
+	if unreadable > 0 {
+		return nil, fmt.Errorf("no file named %s in the manifest, %d entries could not be opened with your_key or your identity", name, unreadable)
+	}
+	return nil, fmt.Errorf("no file named %s in the manifest", name)
+}
+
+func splitVersion(query string) (name string, version int) {
+	if at := strings.LastIndex(query, "@"); at > 0 {
+		if n, err := strconv.Atoi(query[at+1:]); err == nil {
+			return query[:at], n
+		}
+	}
+	return query, 0
+}
+
+// pickVersion returns version N of a file, 1 being the newest. Without a version the newest is picked
+// and the others are listed so the user can choose.
+func pickVersion(name string, versions []*manifestEntry, version int, verb string) (*manifestEntry, error) {
+	if version == 0 {
+		if len(versions) > 1 {
+			logger.Printf("%d versions of %s found, %s the newest. Use %s@N to pick:\n", len(versions), name, verb, name)
+			for n, entry := range versions {
+				logger.Printf("  %s@%d  %s  %s  %s\n", entry.name, n+1, formatSize(entry.size), entry.uploaded.Local().Format("2006-01-02 15:04"), entry.messageID)
+			}
+		}
+		version = 1
+	}
+
+	if version < 1 || version > len(versions) {
+		return nil, fmt.Errorf("%s has %d versions, %d is out of range", name, len(versions), version)
+	}
+
+	return versions[version-1], nil
+}
+
+// findEntry resolves a manifest reference or a name, optionally suffixed with @N. References that are
+// not in the manifest are returned as chainEnd, as printed for uploads made before the manifest index.
+func findEntry(query string, verb string) (entry *manifestEntry, chainEnd string, err error) {
+	if isSnowflake(query) {
+		message, err := backend.GetMessage(backend.ManifestChannel(), query)
+		if err == nil {
+			entry, err := parseManifestEntry(message)
+			return entry, "", err
+		}
+		if !errors.Is(err, errNotFound) {
+			return nil, "", err
+		}
+		if _, err := findDataMessage(query, ""); err == nil {
+			return nil, query, nil
+		}
+	}
+
+	name, version := splitVersion(query)
+
+	versions, err := resolveFile(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	entry, err = pickVersion(name, versions, version, verb)
+	return entry, "", err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckManifestEntry(t *testing.T) {
+	fits := strings.Repeat("m", maxMessageLength-1-maxReferenceLength)
+	if err := checkManifestEntry(fits); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkManifestEntry(fits + "m"); err == nil {
+		t.Fatal("accepted a meta whose entry can't fit in a message")
+	}
+}
+
+func TestSplitVersion(t *testing.T) {
+	for query, want := range map[string]struct {
+		name    string
+		version int
+	}{
+		"file.txt":    {"file.txt", 0},
+		"file.txt@2":  {"file.txt", 2},
+		"a@b.txt":     {"a@b.txt", 0},
+		"@3":          {"@3", 0},
+		"dir/f.txt@1": {"dir/f.txt", 1},
+	} {
+		if name, version := splitVersion(query); name != want.name || version != want.version {
+			t.Fatalf("%q: got %q@%d", query, name, version)
+		}
+	}
+}
+
+func listedNames(t *testing.T, args []string, flags map[string]string) []string {
+	t.Helper()
+
+	entries, _, err := listEntries(args, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.name)
+	}
+
+	return names
+}
+
+func TestListEntries(t *testing.T) {
+	dir := setupTest(t)
+
+	for name, size := range map[string]int{"a.txt": 3000, "b.bin": 9000, "c.txt": 500} {
+		writeRandomFile(t, filepath.Join(dir, name), size)
+	}
+	for _, name := range []string{"a.txt", "b.bin", "c.txt"} {
+		sendTestFile(t, filepath.Join(dir, name), 1, nil)
+	}
+	a, b, c := testEntry(t, "a.txt").messageID, testEntry(t, "b.bin").messageID, testEntry(t, "c.txt").messageID
+
+	for _, test := range []struct {
+		args  []string
+		flags map[string]string
+		want  []string
+	}{
+		{nil, map[string]string{}, []string{"c.txt", "b.bin", "a.txt"}},
+		{[]string{"*.txt"}, map[string]string{}, []string{"c.txt", "a.txt"}},
+		{[]string{"?.bin"}, map[string]string{}, []string{"b.bin"}},
+		{[]string{"*.md"}, map[string]string{}, nil},
+		{nil, map[string]string{"sort": "name"}, []string{"a.txt", "b.bin", "c.txt"}},
+		{nil, map[string]string{"sort": "name", "reverse": ""}, []string{"c.txt", "b.bin", "a.txt"}},
+		{nil, map[string]string{"sort": "size"}, []string{"b.bin", "a.txt", "c.txt"}},
+		{nil, map[string]string{"sort": "chunks"}, []string{"b.bin", "c.txt", "a.txt"}},
+		{nil, map[string]string{"reverse": ""}, []string{"a.txt", "b.bin", "c.txt"}},
+		{nil, map[string]string{"before": b}, []string{"a.txt"}},
+		{nil, map[string]string{"after": a}, []string{"c.txt", "b.bin"}},
+		{nil, map[string]string{"before": c, "after": a}, []string{"b.bin"}},
+		{[]string{"*.txt"}, map[string]string{"after": a}, []string{"c.txt"}},
+	} {
+		if got := listedNames(t, test.args, test.flags); !slices.Equal(got, test.want) {
+			t.Fatalf("list %v %v: got %v, want %v", test.args, test.flags, got, test.want)
+		}
+	}
+
+	if _, _, err := listEntries(nil, map[string]string{"sort": "color"}); err == nil {
+		t.Fatal("accepted an unknown sort")
+	}
+	if _, _, err := listEntries([]string{"["}, map[string]string{}); err == nil {
+		t.Fatal("accepted an invalid pattern")
+	}
+}
+
+// TestListPages lists more entries than fit in one page of the manifest channel.
+func TestListPages(t *testing.T) {
+	dir := setupTest(t)
+
+	count := manifestPageSize + 20
+	var ids []string
+	for i := 0; i < count; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file%03d", i))
+		writeRandomFile(t, path, 10)
+		sendTestFile(t, path, 1, nil)
+		ids = append(ids, testEntry(t, filepath.Base(path)).messageID)
+	}
+
+	if names := listedNames(t, nil, map[string]string{}); len(names) != count || names[0] != fmt.Sprintf("file%03d", count-1) {
+		t.Fatalf("listed %d of %d files", len(names), count)
+	}
+
+	// Paging forward from an old entry and back from a recent one both cross a page boundary.
+	if names := listedNames(t, nil, map[string]string{"after": ids[5]}); len(names) != count-6 || names[len(names)-1] != "file006" {
+		t.Fatalf("listed %d files after the 6th", len(names))
+	}
+	if names := listedNames(t, nil, map[string]string{"before": ids[count-5]}); len(names) != count-5 || names[0] != fmt.Sprintf("file%03d", count-6) {
+		t.Fatalf("listed %d files before the 5th newest", len(names))
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// parityEncoder builds the parity chunks of an upload as its chunks are confirmed. Parity is computed
+// over the encrypted attachments, padded with zeros to the largest chunk of the group, so a rebuilt
+// chunk is authenticated like any other. Only the parity of groups still being sent is kept in memory.
+type parityEncoder struct {
+	f            *chunkedFile
+	dataChannels []string
+	groups       map[int]*parityGroup
+	mu           sync.Mutex
+}
+
+type parityGroup struct {
+	shards [][]byte
+	added  int
+}
+
+func parityGroups(f *chunkedFile) int {
+	return (f.chunks + f.parityData - 1) / f.parityData
+}
+
+// applyParity overrides the parity ratio of a file, which can't change once its upload started.
+func applyParity(f *chunkedFile, ratio string) error {
+	data, parity, err := parseParity(ratio)
+	if err != nil {
+		return err
+	}
+
+	if f.journal != nil && (data != f.journal.ParityData || parity != f.journal.ParityShards) {
+		return fmt.Errorf("parity changed since the upload was started, resume without --parity")
+	}
+
+	f.parityData, f.parityShards = data, parity
+	return nil
+}
+
+func newParityEncoder(f *chunkedFile, dataChannels []string) *parityEncoder {
+	return &parityEncoder{f: f, dataChannels: dataChannels, groups: make(map[int]*parityGroup)}
+}
+
+// add folds an uploaded chunk into the parity of its group, uploading the parity chunks once every
+// chunk of the group is in. Groups whose parity was uploaded before resuming are skipped.
+func (p *parityEncoder) add(n int, sealed []byte) error {
+	k, m := p.f.parityData, p.f.parityShards
+	g := n / k
+
+	if p.f.journal.parityDone(g) {
+		return nil
+	}
+
+	p.mu.Lock()
+	group, ok := p.groups[g]
+	if !ok {
+		group = &parityGroup{shards: make([][]byte, m)}
+		p.groups[g] = group
+	}
+
+	for i := range group.shards {
+		if len(group.shards[i]) < len(sealed) {
+			group.shards[i] = append(group.shards[i], make([]byte, len(sealed)-len(group.shards[i]))...)
+		}
+		gfMulAdd(group.shards[i], sealed, cauchyElement(k, i, n%k))
+	}
+	group.added++
+
+	size := k
+	if rest := p.f.chunks - g*k; rest < k {
+		size = rest
+	}
+	complete := group.added == size
+	if complete {
+		delete(p.groups, g)
+	}
+	p.mu.Unlock()
+
+	if !complete {
+		return nil
+	}
+
+	for i, shard := range group.shards {
+		slot := g*m + i
+		if p.f.journal.Parity[slot].Message != "" {
+			continue
+		}
+
+		message := messageCreate{
+			ChannelID: p.dataChannels[slot%len(p.dataChannels)],
+			Data:      shard,
+			FileName:  fmt.Sprintf("parity%d.enc", slot),
+		}
+
+		messageID, err := backend.PutChunk(message)
+		if err != nil {
+			return fmt.Errorf("error sending parity chunk %d: %v", slot, err)
+		}
+
+		if err := p.f.journal.recordParity(slot, chunkRef{Channel: message.ChannelID, Message: messageID, Size: len(shard)}); err != nil {
+			return fmt.Errorf("error writing upload journal: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// storedChunk downloads the attachment a chunk ref points to.
+func storedChunk(ref chunkRef) ([]byte, error) {
+	message, err := backend.GetMessage(ref.Channel, ref.Message)
+	if err != nil {
+		return nil, err
+	}
+	if len(message.Attachments) == 0 {
+		return nil, fmt.Errorf("message %s has no attachment", ref.Message)
+	}
+
+	return backend.GetChunk(message.Attachments[0])
+}
+
+// recoverChunk rebuilds a chunk that couldn't be downloaded from the rest of its group. Every chunk of
+// the group rebuilt along the way is kept until it is asked for.
+func (f *chunkedFile) recoverChunk(key []byte, n int) ([]byte, error) {
+	f.recoverMu.Lock()
+	defer f.recoverMu.Unlock()
+
+	sealed, ok := f.recovered[n]
+	if !ok {
+		if err := f.recoverGroup(key, n/f.parityData, n); err != nil {
+			return nil, err
+		}
+		sealed = f.recovered[n]
+	}
+	delete(f.recovered, n)
+
+	plaintext, err := decryptChunk(f, sealed, key, n)
+	if err == nil {
+		err = f.verifyChunk(n, plaintext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rebuilt chunk %d is corrupt: %v", n, err)
+	}
+
+	return plaintext, nil
+}
+
+// recoverGroup downloads shards of group g until enough are intact to rebuild its missing chunks. Data
+// chunks are authenticated before they are used; chunk n is known to be bad and never is.
+func (f *chunkedFile) recoverGroup(key []byte, g int, n int) error {
+	k, m := f.parityData, f.parityShards
+
+	length := 0
+	for j := g * k; j < (g+1)*k && j < f.chunks; j++ {
+		if f.sizes[j] > length {
+			length = f.sizes[j]
+		}
+	}
+
+	shards := make([][]byte, k+m)
+	available := 0
+
+	for j := 0; j < k && available < k; j++ {
+		c := g*k + j
+		if c >= f.chunks {
+			shards[j] = make([]byte, length)
+			available++
+			continue
+		}
+		if c == n || f.messages[c] == nil || len(f.messages[c].Attachments) == 0 {
+			continue
+		}
+
+		chunk, err := backend.GetChunk(f.messages[c].Attachments[0])
+		if err != nil || len(chunk) != f.sizes[c] {
+			continue
+		}
+		plaintext, err := decryptChunk(f, chunk, key, c)
+		if err != nil || f.verifyChunk(c, plaintext) != nil {
+			continue
+		}
+
+		shards[j] = append(chunk, make([]byte, length-len(chunk))...)
+		available++
+	}
+
+	for i := 0; i < m && available < k; i++ {
+		chunk, err := storedChunk(f.parityRefs[g*m+i])
+		if err != nil || len(chunk) != length {
+			continue
+		}
+
+		shards[k+i] = chunk
+		available++
+	}
+
+	if err := reconstructShards(shards, k); err != nil {
+		return fmt.Errorf("can't rebuild chunk %d from parity: %v", n, err)
+	}
+
+	if f.recovered == nil {
+		f.recovered = make(map[int][]byte)
+	}
+	for j := 0; j < k && g*k+j < f.chunks; j++ {
+		c := g*k + j
+		if _, ok := f.recovered[c]; !ok && (c == n || f.messages[c] == nil) {
+			f.recovered[c] = shards[j][:f.sizes[c]]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	globalRequestsPerSecond = 50
+	maxRateLimitWaits       = 50
+	backoffBase             = 500 * time.Millisecond
+	backoffMax              = 30 * time.Second
+)
+
+type rateLimitBucket struct {
+	mu        sync.Mutex
+	remaining int
+	reset     time.Time
+}
+
+type discordClient struct {
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	routes      map[string]string
+	buckets     map[string]*rateLimitBucket
+	globalReset time.Time
+	windowStart time.Time
+	windowCount int
+}
+
+var client = newDiscordClient()
+
+func newDiscordClient() *discordClient {
+	return &discordClient{
+		httpClient: http.DefaultClient,
+		routes:     make(map[string]string),
+		buckets:    make(map[string]*rateLimitBucket),
+	}
+}
+
+// routeKey identifies the rate limit route of an API request. Discord buckets are shared per route,
+// but scoped by the major parameter (channel, guild or webhook ID), so only minor IDs are wildcarded.
+func routeKey(method string, u *url.URL) (route string, major string) {
+	path := strings.TrimPrefix(u.Path, "/api/v10")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	for i, segment := range segments {
+		if _, err := strconv.ParseUint(segment, 10, 64); err != nil {
+			continue
+		}
+		if i == 1 && (segments[0] == "channels" || segments[0] == "guilds" || segments[0] == "webhooks") {
+			major = segments[0] + "/" + segment
+			continue
+		}
+		segments[i] = ":id"
+	}
+
+	return method + " /" + strings.Join(segments, "/"), major
+}
+
+func (c *discordClient) bucket(route string, major string) *rateLimitBucket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hash, ok := c.routes[route]
+	if !ok {
+		hash = route
+	}
+
+	key := hash + "|" + major
+	b, ok := c.buckets[key]
+	if !ok {
+		b = &rateLimitBucket{remaining: 1}
+		c.buckets[key] = b
+	}
+
+	return b
+}
+
+func (c *discordClient) setRouteBucket(route string, major string, hash string) *rateLimitBucket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous, ok := c.routes[route]
+	if !ok {
+		previous = route
+	}
+
+	c.routes[route] = hash
+
+	key := hash + "|" + major
+	b, ok := c.buckets[key]
+	if !ok {
+		b = c.buckets[previous+"|"+major]
+		if b == nil {
+			b = &rateLimitBucket{remaining: 1}
+		}
+		c.buckets[key] = b
+	}
+
+	return b
+}
+
+func (c *discordClient) waitGlobal() {
+	for {
+		c.mu.Lock()
+		now := time.Now()
+
+		var wait time.Duration
+		if now.Before(c.globalReset) {
+			wait = c.globalReset.Sub(now)
+		} else if now.Sub(c.windowStart) >= time.Second {
+			c.windowStart = now
+			c.windowCount = 1
+		} else if c.windowCount < globalRequestsPerSecond {
+			c.windowCount++
+		} else {
+			wait = c.windowStart.Add(time.Second).Sub(now)
+		}
+		c.mu.Unlock()
+
+		if wait <= 0 {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// wait takes a request from the bucket, sleeping until its reset when it is used up. The lock is not
+// held while sleeping, so responses of requests in flight can still update the bucket.
+func (b *rateLimitBucket) wait() {
+	for {
+		b.mu.Lock()
+		wait := time.Until(b.reset)
+		if b.remaining > 0 || wait <= 0 {
+			if b.remaining > 0 {
+				b.remaining--
+			}
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+
+		time.Sleep(wait)
+	}
+}
+
+func (b *rateLimitBucket) update(header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	resetAfter, err := strconv.ParseFloat(header.Get("X-RateLimit-Reset-After"), 64)
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.remaining = remaining
+	b.reset = time.Now().Add(time.Duration(resetAfter * float64(time.Second)))
+}
+
+func (b *rateLimitBucket) block(until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.remaining = 0
+	if until.After(b.reset) {
+		b.reset = until
+	}
+}
+
+func backoff(attempt int) time.Duration {
+	delay := backoffBase << (attempt - 1)
+	if delay > backoffMax || delay <= 0 {
+		delay = backoffMax
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// do sends a request, waiting out Discord rate limits and retrying 429s, 5xx responses and transport
+// errors. The request body must be replayable, which http.NewRequest ensures for in-memory bodies.
+func (c *discordClient) do(req *http.Request) (*http.Response, error) {
+	isAPI := strings.HasPrefix(req.URL.String(), apiBase)
+	route, major := routeKey(req.Method, req.URL)
+
+	rateLimited := 0
+	for attempt := 1; ; attempt++ {
+		var b *rateLimitBucket
+		if isAPI {
+			c.waitGlobal()
+			b = c.bucket(route, major)
+			b.wait()
+		}
+
+		attemptReq := req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq.Body = body
+		}
+
+		resp, err := c.httpClient.Do(attemptReq)
+		if err != nil {
+			if attempt >= config.Int("max_retry") {
+				return nil, err
+			}
+			delay := backoff(attempt)
+			logger.Printf("Request %s failed: %v. Retrying in %v (attempt %d/%d)\n", route, err, delay.Round(time.Millisecond), attempt, config.Int("max_retry"))
+			time.Sleep(delay)
+			continue
+		}
+
+		if isAPI {
+			if hash := resp.Header.Get("X-RateLimit-Bucket"); hash != "" {
+				b = c.setRouteBucket(route, major, hash)
+			}
+			b.update(resp.Header)
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			var body struct {
+				RetryAfter float64 `json:"retry_after"`
+				Global     bool    `json:"global"`
+			}
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			json.Unmarshal(data, &body)
+
+			retryAfter := time.Duration(body.RetryAfter * float64(time.Second))
+			if retryAfter <= 0 {
+				if seconds, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil {
+					retryAfter = time.Duration(seconds * float64(time.Second))
+				} else {
+					retryAfter = time.Second
+				}
+			}
+
+			rateLimited++
+			if rateLimited > maxRateLimitWaits {
+				return nil, fmt.Errorf("still rate limited on %s after %d waits", route, maxRateLimitWaits)
+			}
+
+			until := time.Now().Add(retryAfter)
+			if body.Global || resp.Header.Get("X-RateLimit-Global") == "true" || resp.Header.Get("X-RateLimit-Scope") == "global" {
+				c.mu.Lock()
+				if until.After(c.globalReset) {
+					c.globalReset = until
+				}
+				c.mu.Unlock()
+			} else if b != nil {
+				b.block(until)
+			} else {
+				time.Sleep(retryAfter)
+			}
+
+			logger.Printf("Rate limited on %s, waiting %v\n", route, retryAfter.Round(time.Millisecond))
+			attempt--
+			continue
+		case resp.StatusCode >= 500:
+			if attempt >= config.Int("max_retry") {
+				return resp, nil
+			}
+			resp.Body.Close()
+			delay := backoff(attempt)
+			logger.Printf("Request %s returned %s. Retrying in %v (attempt %d/%d)\n", route, resp.Status, delay.Round(time.Millisecond), attempt, config.Int("max_retry"))
+			time.Sleep(delay)
+			continue
+		}
+
+		return resp, nil
+	}
+}
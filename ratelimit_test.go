@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redirectTransport sends requests for the Discord API to a test server instead.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (r redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = r.target.Scheme
+	req.URL.Host = r.target.Host
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newTestClient returns a client whose API requests are answered by handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *discordClient {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newDiscordClient()
+	c.httpClient = &http.Client{Transport: redirectTransport{target}}
+
+	return c
+}
+
+// timedRequest lists the messages of a channel and returns the status and how long it took.
+func timedRequest(c *discordClient, channel string) (int, time.Duration, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/channels/%s/messages", apiBase, channel), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start := time.Now()
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode, time.Since(start), nil
+}
+
+func testRequest(t *testing.T, c *discordClient, channel string) (int, time.Duration) {
+	t.Helper()
+
+	status, took, err := timedRequest(c, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return status, took
+}
+
+// waitFor polls until done returns true, so a test can act once a response has been handled.
+func waitFor(t *testing.T, done func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !done(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRouteKey(t *testing.T) {
+	for path, want := range map[string][2]string{
+		"/api/v10/channels/123/messages":               {"POST /channels/123/messages", "channels/123"},
+		"/api/v10/channels/123/messages/456":           {"POST /channels/123/messages/:id", "channels/123"},
+		"/api/v10/channels/123/messages/bulk-delete":   {"POST /channels/123/messages/bulk-delete", "channels/123"},
+		"/api/v10/guilds/789/channels":                 {"POST /guilds/789/channels", "guilds/789"},
+		"/api/v10/webhooks/1/token/messages/2":         {"POST /webhooks/1/token/messages/:id", "webhooks/1"},
+		"/api/v10/users/@me":                           {"POST /users/@me", ""},
+		"/api/v10/channels/123/messages/456/reactions": {"POST /channels/123/messages/:id/reactions", "channels/123"},
+	} {
+		route, major := routeKey("POST", &url.URL{Path: path})
+		if route != want[0] || major != want[1] {
+			t.Fatalf("%s: got %q %q", path, route, major)
+		}
+	}
+
+	// Messages of one channel share a bucket, other channels have their own.
+	a, _ := routeKey("DELETE", &url.URL{Path: "/api/v10/channels/1/messages/2"})
+	b, _ := routeKey("DELETE", &url.URL{Path: "/api/v10/channels/1/messages/3"})
+	if a != b {
+		t.Fatalf("messages of a channel got routes %q and %q", a, b)
+	}
+}
+
+func TestRateLimitedBucket(t *testing.T) {
+	setupTest(t)
+
+	var mu sync.Mutex
+	limited := false
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path == "/api/v10/channels/1/messages" && !limited {
+			limited = true
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"retry_after": 0.4, "global": false}`)
+			return
+		}
+	})
+
+	done := make(chan time.Duration)
+	go func() {
+		_, took, err := timedRequest(c, "1")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- took
+	}()
+
+	waitFor(t, func() bool {
+		b := c.bucket("GET /channels/1/messages", "channels/1")
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return !b.reset.IsZero()
+	})
+
+	// Another channel isn't held back by the limited bucket.
+	if _, took := testRequest(t, c, "2"); took > 200*time.Millisecond {
+		t.Fatalf("request to another channel waited %v", took)
+	}
+
+	if took := <-done; took < 350*time.Millisecond {
+		t.Fatalf("retried after %v, before retry_after", took)
+	}
+}
+
+func TestRateLimitedGlobally(t *testing.T) {
+	setupTest(t)
+
+	var mu sync.Mutex
+	limited := false
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !limited {
+			limited = true
+			w.Header().Set("X-RateLimit-Global", "true")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"retry_after": 0.4, "global": true}`)
+			return
+		}
+	})
+
+	done := make(chan time.Duration)
+	go func() {
+		_, took, err := timedRequest(c, "1")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- took
+	}()
+
+	waitFor(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return !c.globalReset.IsZero()
+	})
+
+	// A global limit holds back every route.
+	if _, took := testRequest(t, c, "2"); took < 250*time.Millisecond {
+		t.Fatalf("request to another channel went through a global limit after %v", took)
+	}
+
+	if took := <-done; took < 350*time.Millisecond {
+		t.Fatalf("retried after %v, before retry_after", took)
+	}
+}
+
+func TestServerErrorBackoff(t *testing.T) {
+	setupTest(t)
+	config.SetInt("max_retry", 3)
+
+	var mu sync.Mutex
+	requests := 0
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+		if r.URL.Path == "/api/v10/channels/1/messages" || requests == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+
+	// The first error is retried.
+	if status, took := testRequest(t, c, "2"); status != http.StatusOK || count() != 2 {
+		t.Fatalf("got %d after %d requests", status, count())
+	} else if took < backoffBase/2 {
+		t.Fatalf("retried after %v without backing off", took)
+	}
+
+	// An error that persists is returned once max_retry requests were made.
+	if status, _ := testRequest(t, c, "1"); status != http.StatusBadGateway || count() != 5 {
+		t.Fatalf("got %d with %d requests made in total", status, count())
+	}
+}
+
+func TestRateLimitRemaining(t *testing.T) {
+	setupTest(t)
+
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset-After", "0.4")
+	})
+
+	if _, took := testRequest(t, c, "1"); took > 200*time.Millisecond {
+		t.Fatalf("first request waited %v", took)
+	}
+
+	// The bucket is used up until its reset.
+	if _, took := testRequest(t, c, "1"); took < 350*time.Millisecond {
+		t.Fatalf("request went through a used up bucket after %v", took)
+	}
+
+	if _, took := testRequest(t, c, "2"); took > 200*time.Millisecond {
+		t.Fatalf("request to another channel waited %v", took)
+	}
+}
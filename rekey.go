@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// newKeyEnv is the environment variable rekey reads the new key from when no --key-file is given.
+const newKeyEnv = "DISCORD_FS_NEW_KEY"
+
+// readNewKey reads the key rekey switches to from the file given with --key-file, from newKeyEnv or
+// from a prompt that doesn't echo it. It isn't taken as an argument, which would leave it on screen and
+// in error messages.
+func readNewKey(args []string, flags map[string]string) (string, error) {
+	if len(args) > 0 {
+		return "", fmt.Errorf("the new key isn't taken as an argument, use --key-file, %s or enter it when asked", newKeyEnv)
+	}
+
+	var key string
+	if file, ok := flags["key-file"]; ok {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("error reading key file: %v", err)
+		}
+		key = strings.TrimRight(string(data), "\r\n")
+	} else if value, ok := os.LookupEnv(newKeyEnv); ok {
+		key = value
+	} else {
+		var err error
+		if key, err = readPassword("New key: "); err != nil {
+			return "", err
+		}
+
+		confirm, err := readPassword("Repeat the new key: ")
+		if err != nil {
+			return "", err
+		}
+		if confirm != key {
+			return "", fmt.Errorf("the keys don't match")
+		}
+	}
+
+	// The config parser trims lines, so such a key wouldn't read back the same.
+	if key == "" || strings.TrimSpace(key) != key || strings.ContainsAny(key, "\r\n") {
+		return "", fmt.Errorf("the new key can't be empty, start or end with spaces or span lines")
+	}
+
+	return key, nil
+}
+
+// saveConfigKey sets your_key in the config file, leaving the rest of it as it is. The file is
+// replaced in one go, so an interrupted write can't leave it without a key.
+func saveConfigKey(file string, key string) error {
+	data, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	mode := os.FileMode(0o600)
+	if stat, err := os.Stat(file); err == nil {
+		mode = stat.Mode().Perm()
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+
+	section, stringSection, replaced := "", -1, false
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			if section == "string" && stringSection < 0 {
+				stringSection = i
+			}
+			continue
+		}
+
+		if section == "string" && strings.HasPrefix(line, "your_key=") {
+			lines[i] = "your_key=" + key
+			replaced = true
+		}
+	}
+
+	switch {
+	case replaced:
+	case stringSection >= 0:
+		lines = slices.Insert(lines, stringSection+1, "your_key="+key)
+	default:
+		lines = append(lines, "[string]", "your_key="+key)
+	}
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// rekeyReplicas wraps the data keys of every file with a new key, on the replica picked with --replica
+// or on all of them. your_key is switched to the new key and saved to the config once every file was
+// rekeyed, so the new key can't be lost with the program.
+func rekeyReplicas(newPassword string, flags map[string]string) error {
+	if newPassword == config.String("your_key") {
+		return fmt.Errorf("the new key is the same as your_key")
+	}
+
+	// Saving the key must not fail once files are under it.
+	tmp := *configPath + ".tmp"
+	if err := os.WriteFile(tmp, nil, 0o600); err != nil {
+		return fmt.Errorf("the new key couldn't be saved to %s: %v", *configPath, err)
+	}
+	os.Remove(tmp)
+
+	rekeyed := 0
+	rekey := func() error {
+		n, err := rekeyFiles(newPassword)
+		rekeyed += n
+		return err
+	}
+
+	var err error
+	if _, ok := flags["replica"]; ok {
+		err = onReplicaFlag(flags, rekey)
+	} else {
+		for _, r := range replicas {
+			if r.err != nil {
+				logger.Printf("Replica %s is unavailable, its files are left under the old key\n", r.name)
+				continue
+			}
+
+			if len(replicas) > 1 {
+				logger.Printf("Rekeying replica %s\n", r.name)
+			}
+
+			if err = onReplica(r, rekey); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if rekeyed == 0 {
+		return fmt.Errorf("no file could be rekeyed with your_key, nothing was rekeyed")
+	}
+
+	config.SetString("your_key", newPassword)
+	if err := saveConfigKey(*configPath, newPassword); err != nil {
+		return fmt.Errorf("every file was rekeyed but the new key couldn't be saved to %s: %v; set your_key to it before restarting", *configPath, err)
+	}
+	logger.Printf("Now using the new key, saved as your_key in %s\n", *configPath)
+
+	return nil
+}
+
+// rekeyFiles rewraps the data key of every file readable with your_key. Only metas change: manifest
+// entries and the first chunk of chained uploads are edited in place, so references stay the same.
+// Files already under the new key don't open with your_key and are skipped, so an interrupted rekey
+// can be run again. So are files shared with this identity by someone else, and files whose meta
+// predates sealed metas, which have no data key to wrap.
+func rekeyFiles(newPassword string) (int, error) {
+	var entries []*manifestEntry
+	var legacy []string
+	unreadable, err := walkManifest("", "", func(entry *manifestEntry) bool {
+		switch {
+		case entry.viaIdentity:
+		case !strings.HasPrefix(entry.meta, metaEnvelopePrefix):
+			legacy = append(legacy, entry.name)
+		default:
+			entries = append(entries, entry)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error reading manifest: %v", err)
+	}
+
+	if unreadable > 0 {
+		logger.Printf("Skipping %d manifest entries that don't open with your_key, already rekeyed or sent with another key\n", unreadable)
+	}
+
+	if len(legacy) > 0 {
+		logger.Printf("Skipping %d files sent before metas were sealed, they stay under the old key until sent again: %s\n", len(legacy), strings.Join(legacy, ", "))
+	}
+
+	failed := 0
+	for n, entry := range entries {
+		logger.AddLine("rekey", fmt.Sprintf("Rekeying %s; %s", entry.name, ProgressBarUtil(n, len(entries))))
+
+		if err := rekeyEntry(entry, newPassword); err != nil {
+			logger.Printf("Error rekeying %s: %v\n", entry.name, err)
+			failed++
+		}
+	}
+
+	logger.RemoveLine("rekey")
+	logger.Printf("Rekeyed %d/%d files\n", len(entries)-failed, len(entries))
+
+	if failed > 0 {
+		return len(entries) - failed, fmt.Errorf("%d files could not be rekeyed, run rekey again to retry", failed)
+	}
+
+	return len(entries), nil
+}
+
+// rekeyEntry edits the first chunk of the file before its manifest entry, so a copy of the old meta
+// is never left behind once the entry is rekeyed.
+func rekeyEntry(entry *manifestEntry, newPassword string) error {
+	meta, err := rewrapMeta(entry.meta, config.String("your_key"), newPassword)
+	if err != nil {
+		return err
+	}
+
+	if !entry.dir {
+		index, err := readFileIndex(entry)
+		if err != nil {
+			logger.Printf("%s: %v, its first chunk keeps the old metadata\n", entry.name, err)
+		} else if len(index.Chunks) > 0 {
+			ref := index.Chunks[0]
+			message, err := backend.GetMessage(ref.Channel, ref.Message)
+			if err != nil && !errors.Is(err, errNotFound) {
+				return err
+			}
+
+			if message != nil && message.Content == entry.meta {
+				if err := backend.EditMessage(ref.Channel, ref.Message, meta); err != nil {
+					return fmt.Errorf("error editing chunk 0: %v", err)
+				}
+			}
+		}
+	}
+
+	if err := backend.EditMessage(backend.ManifestChannel(), entry.messageID, formatManifestEntry(meta, entry.reference)); err != nil {
+		return fmt.Errorf("error editing manifest entry: %v", err)
+	}
+
+	return nil
+}
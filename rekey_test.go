@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRekey(t *testing.T) {
+	dir := setupTest(t)
+
+	cfg := "[bool]\ndedup=false\n[string]\nserver_id=1 # keep this\nyour_key=test key\n[int]\nmax_retry=2\n"
+	if err := os.WriteFile(*configPath, []byte(cfg), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	chained := filepath.Join(dir, "chained.bin")
+	chainedData := writeRandomFile(t, chained, 12000)
+	sendTestFile(t, chained, 1, nil)
+
+	config.SetBool("dedup", true)
+	deduped := filepath.Join(dir, "deduped.bin")
+	dedupedData := writeRandomFile(t, deduped, 12000)
+	sendTestFile(t, deduped, 2, nil)
+	sharedKey := sharedChunks.Key
+
+	legacyData := make([]byte, 1500)
+	io.ReadFull(rand.Reader, legacyData)
+	legacyReference := sendLegacyChain(t, "legacy.bin", legacyData)
+
+	reference := testEntry(t, "chained.bin").reference
+
+	if err := rekeyReplicas("new key", map[string]string{}); err != nil {
+		t.Fatalf("rekey: %v", err)
+	}
+	if config.String("your_key") != "new key" {
+		t.Fatal("your_key wasn't switched to the new key")
+	}
+	if saved, _ := os.ReadFile(*configPath); string(saved) != strings.Replace(cfg, "your_key=test key", "your_key=new key", 1) {
+		t.Fatalf("config saved as %q", saved)
+	}
+	if stat, err := os.Stat(*configPath); err != nil || stat.Mode().Perm() != 0o640 {
+		t.Fatal("saving the config changed its permissions")
+	}
+
+	fetchTestFile(t, "chained.bin", chainedData)
+	fetchTestFile(t, reference, chainedData)
+	fetchTestFile(t, "deduped.bin", dedupedData)
+
+	if entry := testEntry(t, "deduped.bin"); !bytes.Equal(entry.sharedKey, sharedKey) {
+		t.Fatal("rekeyed file lost its shared chunk key")
+	}
+
+	// Files with a plaintext meta are skipped and stay readable with the old key only.
+	config.SetString("your_key", "test key")
+	fetchTestFile(t, legacyReference, legacyData)
+	config.SetString("your_key", "new key")
+
+	// A second rekey is not held back by the legacy file.
+	if err := rekeyReplicas("newer key", map[string]string{}); err != nil {
+		t.Fatalf("second rekey: %v", err)
+	}
+	fetchTestFile(t, "chained.bin", chainedData)
+
+	// The chunk index keeps its key, so dedup carries on across the rekey.
+	again := filepath.Join(dir, "again.bin")
+	if err := os.WriteFile(again, dedupedData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sendTestFile(t, again, 2, nil)
+
+	first := make(map[string]bool)
+	for _, ref := range testIndex(t, "deduped.bin").Chunks {
+		first[ref.Message] = true
+	}
+	for _, ref := range testIndex(t, "again.bin").Chunks {
+		if !first[ref.Message] {
+			t.Fatal("identical file uploaded chunks again after a rekey")
+		}
+	}
+}
+
+func TestRekeyWithWrongKey(t *testing.T) {
+	dir := setupTest(t)
+
+	path := filepath.Join(dir, "file.bin")
+	writeRandomFile(t, path, 5000)
+	sendTestFile(t, path, 1, nil)
+
+	config.SetString("your_key", "wrong key")
+	if err := rekeyReplicas("new key", map[string]string{}); err == nil {
+		t.Fatal("rekey succeeded without any file opening with your_key")
+	}
+	if config.String("your_key") != "wrong key" {
+		t.Fatal("your_key was switched although nothing was rekeyed")
+	}
+	if _, err := os.Stat(*configPath); !os.IsNotExist(err) {
+		t.Fatal("config written although nothing was rekeyed")
+	}
+}
+
+func TestReadNewKey(t *testing.T) {
+	dir := setupTest(t)
+
+	if _, err := readNewKey([]string{"new key"}, map[string]string{}); err == nil {
+		t.Fatal("took the new key as an argument")
+	}
+
+	file := filepath.Join(dir, "new.key")
+	os.WriteFile(file, []byte("a key with spaces\n"), 0o600)
+	if key, err := readNewKey(nil, map[string]string{"key-file": file}); err != nil || key != "a key with spaces" {
+		t.Fatalf("read %q from the key file: %v", key, err)
+	}
+
+	t.Setenv(newKeyEnv, "key from the environment")
+	if key, err := readNewKey(nil, map[string]string{}); err != nil || key != "key from the environment" {
+		t.Fatalf("read %q from the environment: %v", key, err)
+	}
+
+	for _, invalid := range []string{"", " padded", "two\nlines"} {
+		t.Setenv(newKeyEnv, invalid)
+		if _, err := readNewKey(nil, map[string]string{}); err == nil {
+			t.Fatalf("accepted the new key %q", invalid)
+		}
+	}
+
+	if got := redactCommand("rekey secret --replica=1"); strings.Contains(got, "secret") {
+		t.Fatalf("rekey logged as %q", got)
+	}
+	if got := redactCommand("fetch file.bin"); got != "fetch file.bin" {
+		t.Fatalf("fetch logged as %q", got)
+	}
+}
+
+func TestSaveConfigKey(t *testing.T) {
+	dir := setupTest(t)
+
+	for cfg, want := range map[string]string{
+		"":                     "[string]\nyour_key=new\n",
+		"[int]\nmax_retry=2\n": "[int]\nmax_retry=2\n[string]\nyour_key=new\n",
+		"[string]\nserver_id=1\n[int]\nmax_retry=2": "[string]\nyour_key=new\nserver_id=1\n[int]\nmax_retry=2\n",
+	} {
+		file := filepath.Join(dir, "discord-fs.cfg")
+		os.WriteFile(file, []byte(cfg), 0o600)
+		if err := saveConfigKey(file, "new"); err != nil {
+			t.Fatal(err)
+		}
+		if saved, _ := os.ReadFile(file); string(saved) != want {
+			t.Fatalf("%q saved as %q", cfg, saved)
+		}
+	}
+}
+
+func TestRewrapMeta(t *testing.T) {
+	setupTest(t)
+
+	kek, salt, err := deriveKey("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileID, _ := generateFileID()
+	key, wrappedKey, err := newFileKey(kek, fileID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := generateMeta(&fileMeta{Name: "file", Size: 3, Chunks: 1, salt: salt, fileID: fileID, wrappedKey: wrappedKey}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, err := rewrapMeta(meta, "old", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newSalt, _, newWrappedKey, _, _, err := splitSealedMeta(rewrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, _, err := openMetaKey("new", newSalt, fileID, newWrappedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, key) {
+		t.Fatal("rewrapped meta holds a different data key")
+	}
+
+	if _, _, err := openMetaKey("old", newSalt, fileID, newWrappedKey); err == nil {
+		t.Fatal("rewrapped meta still opens with the old key")
+	}
+
+	legacy := "bGVnYWN5AGFXNXpaV04xY21VPQ=="
+	if _, err := rewrapMeta(legacy, "old", "new"); err == nil {
+		t.Fatal("rewrapped a plaintext meta")
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// replica is a server files can be written to. The first is the one configured with server_id (or
+// local_path), the others come from the replicas config. Every replica holds independent uploads with
+// their own manifest; copies of a file are matched by name, size and modification time.
+type replica struct {
+	n       int
+	name    string
+	backend Backend
+	chunks  *chunkIndex
+	err     error
+}
+
+var (
+	replicas      []*replica
+	activeReplica *replica
+)
+
+// newReplicas sets up the primary backend and one backend per replica. A replica that can't be reached
+// is kept with its error, so the numbering stays stable.
+func newReplicas() ([]*replica, error) {
+	primary, err := newBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	name := config.String("server_id")
+	if config.String("backend") == "local" {
+		name = config.String("local_path")
+	}
+
+	list := []*replica{{n: 0, name: name, backend: primary}}
+
+	for _, spec := range strings.Split(config.String("replicas"), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" || spec == "none" {
+			continue
+		}
+
+		r := &replica{n: len(list), name: spec}
+
+		switch config.String("backend") {
+		case "local":
+			var b *localBackend
+			if b, r.err = newLocalBackend(spec); r.err == nil {
+				r.backend = b
+			}
+		default:
+			serverID, token, ok := strings.Cut(spec, ":")
+			if !ok {
+				token = config.String("discord_token")
+			}
+			r.name = serverID
+
+			var b *discordBackend
+			if b, r.err = newDiscordBackend(token, serverID); r.err == nil {
+				r.backend = b
+			}
+		}
+
+		if r.err != nil {
+			logger.Printf("Replica %s is unavailable: %v\n", r.name, r.err)
+		}
+
+		list = append(list, r)
+	}
+
+	return list, nil
+}
+
+// initReplicas refreshes the channels of every replica other than the primary.
+func initReplicas() {
+	for _, r := range replicas {
+		if r.n == 0 || r.backend == nil {
+			continue
+		}
+
+		if r.err = r.backend.Init(); r.err != nil {
+			logger.Printf("Error initializing replica %s: %v\n", r.name, r.err)
+			continue
+		}
+
+		logger.Printf("Found replica %s with %d data channels\n", r.name, len(r.backend.DataChannels()))
+	}
+}
+
+// onReplica runs fn with the global backend and chunk index pointed at r. Calls don't nest.
+func onReplica(r *replica, fn func() error) error {
+	if r.n == 0 {
+		return fn()
+	}
+
+	previousBackend, previousChunks := backend, sharedChunks
+	backend, sharedChunks, activeReplica = r.backend, r.chunks, r
+	defer func() {
+		r.chunks = sharedChunks
+		backend, sharedChunks, activeReplica = previousBackend, previousChunks, nil
+	}()
+
+	return fn()
+}
+
+// onReplicaFlag runs fn on the replica picked with --replica=N, 0 being the primary.
+func onReplicaFlag(flags map[string]string, fn func() error) error {
+	value, ok := flags["replica"]
+	if !ok {
+		return fn()
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n >= len(replicas) {
+		return fmt.Errorf("invalid replica %q, expected 0 to %d", value, len(replicas)-1)
+	}
+	if replicas[n].err != nil {
+		return fmt.Errorf("replica %s is unavailable: %v", replicas[n].name, replicas[n].err)
+	}
+
+	return onReplica(replicas[n], fn)
+}
+
+// replicaFile keeps the local state of each replica apart. Files of the primary keep their name, the
+// others get the replica's number before the extension.
+func replicaFile(file string) string {
+	if activeReplica == nil {
+		return file
+	}
+
+	ext := filepath.Ext(file)
+	return fmt.Sprintf("%s.replica%d%s", strings.TrimSuffix(file, ext), activeReplica.n, ext)
+}
+
+// replicaTargets picks the replicas a send writes to: the first replication ones that are available.
+func replicaTargets() ([]*replica, error) {
+	want := config.Int("replication")
+	if want < 1 {
+		want = 1
+	}
+
+	var targets []*replica
+	for _, r := range replicas {
+		if r.err == nil && len(targets) < want {
+			targets = append(targets, r)
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no replica is available")
+	}
+	if len(targets) < want {
+		logger.Printf("Only %d of %d replicas are available, writing %d copies\n", len(targets), want, len(targets))
+	}
+
+	return targets, nil
+}
+
+// sendReplicated writes a file or directory to every target replica in turn. When resuming, the
+// replicas before the first one with an unfinished upload are already done.
+func sendReplicated(path string, workers int, resume bool, flags map[string]string) error {
+	targets, err := replicaTargets()
+	if err != nil {
+		return err
+	}
+
+	start := 0
+	if resume {
+		start = -1
+		for i, r := range targets {
+			onReplica(r, func() error {
+				if file, err := journalFile(path); err == nil {
+					if _, err := os.Stat(file); err == nil {
+						start = i
+					}
+				}
+				return nil
+			})
+			if start >= 0 {
+				break
+			}
+		}
+
+		if start < 0 {
+			return fmt.Errorf("no unfinished upload of %s to resume", path)
+		}
+	}
+
+	for i := start; i < len(targets); i++ {
+		if len(targets) > 1 {
+			logger.Printf("Writing %s to replica %s (%d/%d)\n", path, targets[i].name, i+1, len(targets))
+		}
+
+		err := onReplica(targets[i], func() error {
+			return sendPath(path, workers, resume && i == start, flags)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findReplicaEntry finds the copy of an entry on the active replica: the newest one with the same name,
+// size and modification time.
+func findReplicaEntry(entry *manifestEntry) (*manifestEntry, error) {
+	versions, err := resolveFile(entry.name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range versions {
+		if version.name == entry.name && version.size == entry.size && version.modTime.Equal(entry.modTime) && version.dir == entry.dir {
+			return version, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no copy of %s with the same size and modification time", entry.name)
+}
+
+// fetchFromReplicas retries a fetch that failed on the primary with the copies on the other replicas.
+// The fetch is resumed, so chunks already written are kept when the copy was chunked the same way.
+func fetchFromReplicas(entry *manifestEntry, version int, options fetchOptions, cause error) error {
+	if activeReplica != nil || len(replicas) < 2 {
+		return cause
+	}
+
+	for _, r := range replicas[1:] {
+		if r.err != nil {
+			continue
+		}
+
+		logger.Printf("Error fetching %s: %v. Trying replica %s\n", entry.name, cause, r.name)
+
+		err := onReplica(r, func() error {
+			replicaEntry, err := findReplicaEntry(entry)
+			if err != nil {
+				return err
+			}
+
+			options.resume = true
+			return fetchEntryTo(replicaEntry, version, options)
+		})
+		if err == nil {
+			return nil
+		}
+
+		cause = err
+	}
+
+	return cause
+}
+
+// fetchQueryFromReplicas retries a fetch whose file couldn't be resolved on the primary, for example
+// because its manifest entry is gone or the bot was kicked, by name on the other replicas.
+func fetchQueryFromReplicas(query string, flags map[string]string, options fetchOptions, cause error) error {
+	if activeReplica != nil || len(replicas) < 2 {
+		return cause
+	}
+
+	for _, r := range replicas[1:] {
+		if r.err != nil {
+			continue
+		}
+
+		logger.Printf("%v. Trying replica %s\n", cause, r.name)
+
+		err := onReplica(r, func() error {
+			return fetchQuery(query, flags, options)
+		})
+		if err == nil {
+			return nil
+		}
+
+		cause = err
+	}
+
+	return cause
+}
+
+// deleteFromReplicas deletes the copies of an entry deleted from the primary.
+func deleteFromReplicas(entry *manifestEntry) error {
+	if activeReplica != nil {
+		return nil
+	}
+
+	for _, r := range replicas[1:] {
+		if r.err != nil {
+			logger.Printf("Replica %s is unavailable, its copy of %s is left\n", r.name, entry.name)
+			continue
+		}
+
+		err := onReplica(r, func() error {
+			replicaEntry, err := findReplicaEntry(entry)
+			if err != nil {
+				logger.Printf("Replica %s: %v\n", r.name, err)
+				return nil
+			}
+
+			logger.Printf("Deleting the copy of %s on replica %s\n", entry.name, r.name)
+
+			if replicaEntry.dir {
+				return deleteDirectory(replicaEntry)
+			}
+			return deleteEntry(replicaEntry, replicaEntry.reference, replicaEntry.name, &chunkUsage{exclude: map[string]bool{replicaEntry.messageID: true}})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupReplicas adds a second local server as a replica and writes every file to both.
+func setupReplicas(t *testing.T) string {
+	t.Helper()
+
+	dir := setupTest(t)
+	config.SetString("replicas", filepath.Join(dir, "replica"))
+	config.SetInt("replication", 2)
+
+	var err error
+	if replicas, err = newReplicas(); err != nil {
+		t.Fatal(err)
+	}
+	backend = replicas[0].backend
+	if err := backend.Init(); err != nil {
+		t.Fatal(err)
+	}
+	initReplicas()
+	if replicas[1].err != nil {
+		t.Fatal(replicas[1].err)
+	}
+
+	return dir
+}
+
+func TestFetchFallsBackToReplica(t *testing.T) {
+	dir := setupReplicas(t)
+	config.SetInt("max_retry", 1)
+
+	path := filepath.Join(dir, "file.bin")
+	data := writeRandomFile(t, path, 20000)
+	if err := sendReplicated(path, 1, false, map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+
+	index := testIndex(t, "file.bin")
+	if err := os.Remove(attachmentPath(t, index.Chunks[3])); err != nil {
+		t.Fatal(err)
+	}
+
+	primary := &countingBackend{Backend: backend}
+	second := &countingBackend{Backend: replicas[1].backend}
+	backend, replicas[0].backend, replicas[1].backend = primary, primary, second
+
+	output := filepath.Join(dir, "fetched")
+	if err := fetchFile("file.bin", map[string]string{"output": output, "workers": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(output); string(got) != string(data) {
+		t.Fatal("file fetched from the replica differs")
+	}
+
+	// The copy holds the same chunks, so only those the primary couldn't provide are downloaded again.
+	if primary.downloads < 3 || primary.downloads+second.downloads != len(index.Chunks) {
+		t.Fatalf("%d chunks from the primary and %d from the replica, the file has %d", primary.downloads, second.downloads, len(index.Chunks))
+	}
+}
+
+func TestFetchFindsReplicaCopy(t *testing.T) {
+	dir := setupReplicas(t)
+
+	path := filepath.Join(dir, "file.bin")
+	data := writeRandomFile(t, path, 10000)
+	if err := sendReplicated(path, 2, false, map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without its manifest entry the primary doesn't know the file at all.
+	if err := backend.Delete(backend.ManifestChannel(), []string{testEntry(t, "file.bin").messageID}); err != nil {
+		t.Fatal(err)
+	}
+
+	fetchTestFile(t, "file.bin", data)
+}
+
+func TestSameChunks(t *testing.T) {
+	a := [][]byte{[]byte("one"), []byte("two")}
+
+	for _, test := range []struct {
+		b    [][]byte
+		want bool
+	}{
+		{[][]byte{[]byte("one"), []byte("two")}, true},
+		{[][]byte{[]byte("one"), []byte("three")}, false},
+		{[][]byte{[]byte("one")}, false},
+		{[][]byte{[]byte("one"), nil}, false},
+	} {
+		if got := sameChunks(a, test.b); got != test.want {
+			t.Fatalf("%q and %q: got %v", a, test.b, got)
+		}
+	}
+
+	if sameChunks(nil, nil) {
+		t.Fatal("files without hashes hold the same chunks")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Reed-Solomon erasure coding over GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1. Parity shard i of a
+// group is the sum of every data shard j multiplied by the Cauchy matrix element 1/(x_i+y_j), with
+// x_i = K+i and y_j = j. Every K rows of the identity stacked on a Cauchy matrix are independent, so
+// any K of the K+M shards of a group are enough to rebuild the rest.
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c times src to dst.
+func gfMulAdd(dst []byte, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	logC := int(gfLog[c])
+	for i, b := range src {
+		if b != 0 {
+			dst[i] ^= gfExp[logC+int(gfLog[b])]
+		}
+	}
+}
+
+func cauchyElement(data int, i int, j int) byte {
+	return gfInv(byte(data+i) ^ byte(j))
+}
+
+// parseParity reads a K:M ratio of data to parity chunks. An empty string means no parity.
+func parseParity(ratio string) (data int, parity int, err error) {
+	if ratio == "" || ratio == "none" {
+		return 0, 0, nil
+	}
+
+	k, m, ok := strings.Cut(ratio, ":")
+	if ok {
+		data, err = strconv.Atoi(k)
+	}
+	if ok && err == nil {
+		parity, err = strconv.Atoi(m)
+	}
+	if !ok || err != nil || data < 1 || parity < 1 || data+parity > 256 {
+		return 0, 0, fmt.Errorf("invalid parity %q, expected K:M with K data and M parity chunks per group, at most 256 together", ratio)
+	}
+
+	return data, parity, nil
+}
+
+// invertMatrix inverts a square matrix with Gauss-Jordan elimination.
+func invertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for i := range m {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if work[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, fmt.Errorf("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		inv := gfInv(work[col][col])
+		for k := range work[col] {
+			work[col][k] = gfMul(work[col][k], inv)
+		}
+
+		for row := 0; row < n; row++ {
+			if row != col && work[row][col] != 0 {
+				gfMulAdd(work[row], work[col], work[row][col])
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for i := range work {
+		inverse[i] = work[i][n:]
+	}
+	return inverse, nil
+}
+
+// reconstructShards rebuilds the data shards of a group. shards holds the K data shards followed by
+// the M parity shards, nil where missing, all of the same length; at least K must be present.
+func reconstructShards(shards [][]byte, data int) error {
+	var rows [][]byte
+	var available [][]byte
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+
+		row := make([]byte, data)
+		if i < data {
+			row[i] = 1
+		} else {
+			for j := range row {
+				row[j] = cauchyElement(data, i-data, j)
+			}
+		}
+
+		rows = append(rows, row)
+		available = append(available, shard)
+		if len(rows) == data {
+			break
+		}
+	}
+
+	if len(rows) < data {
+		return fmt.Errorf("%d of %d chunks needed to rebuild the group are available", len(rows), data)
+	}
+
+	inverse, err := invertMatrix(rows)
+	if err != nil {
+		return err
+	}
+
+	size := len(available[0])
+	for j := 0; j < data; j++ {
+		if shards[j] != nil {
+			continue
+		}
+
+		shard := make([]byte, size)
+		for k, coefficient := range inverse[j] {
+			gfMulAdd(shard, available[k], coefficient)
+		}
+		shards[j] = shard
+	}
+
+	return nil
+}
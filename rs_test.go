@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestInvertMatrix(t *testing.T) {
+	const data = 4
+
+	// Identity rows for two data shards and Cauchy rows for two parity shards, as when two data
+	// shards are missing.
+	m := make([][]byte, data)
+	for i := range m {
+		m[i] = make([]byte, data)
+		if i < 2 {
+			m[i][i] = 1
+		} else {
+			for j := range m[i] {
+				m[i][j] = cauchyElement(data, i-2, j)
+			}
+		}
+	}
+
+	inverse, err := invertMatrix(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < data; i++ {
+		for j := 0; j < data; j++ {
+			var sum byte
+			for k := 0; k < data; k++ {
+				sum ^= gfMul(m[i][k], inverse[k][j])
+			}
+
+			want := byte(0)
+			if i == j {
+				want = 1
+			}
+			if sum != want {
+				t.Fatalf("m * inverse is not the identity at %d,%d: %d", i, j, sum)
+			}
+		}
+	}
+
+	singular := [][]byte{{1, 2}, {1, 2}}
+	if _, err := invertMatrix(singular); err == nil {
+		t.Fatal("inverted a singular matrix")
+	}
+}
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInv(byte(a))) != 1 {
+			t.Fatalf("%d * inverse is not 1", a)
+		}
+	}
+}
+
+// encodeTestShards returns data random shards followed by parity shards computed the way
+// parityEncoder does.
+func encodeTestShards(t *testing.T, data int, parity int, size int) [][]byte {
+	t.Helper()
+
+	shards := make([][]byte, data+parity)
+	for j := 0; j < data; j++ {
+		shards[j] = make([]byte, size)
+		if _, err := io.ReadFull(rand.Reader, shards[j]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < parity; i++ {
+		shards[data+i] = make([]byte, size)
+		for j := 0; j < data; j++ {
+			gfMulAdd(shards[data+i], shards[j], cauchyElement(data, i, j))
+		}
+	}
+
+	return shards
+}
+
+func TestReconstructShards(t *testing.T) {
+	const data, parity = 4, 2
+
+	// Every way of losing up to two shards of the group.
+	for a := 0; a < data+parity; a++ {
+		for b := a; b < data+parity; b++ {
+			shards := encodeTestShards(t, data, parity, 100)
+
+			damaged := append([][]byte{}, shards...)
+			damaged[a], damaged[b] = nil, nil
+
+			if err := reconstructShards(damaged, data); err != nil {
+				t.Fatalf("losing shards %d and %d: %v", a, b, err)
+			}
+			for j := 0; j < data; j++ {
+				if !bytes.Equal(damaged[j], shards[j]) {
+					t.Fatalf("losing shards %d and %d: data shard %d rebuilt wrong", a, b, j)
+				}
+			}
+		}
+	}
+
+	shards := encodeTestShards(t, data, parity, 100)
+	shards[0], shards[1], shards[4] = nil, nil, nil
+	if err := reconstructShards(shards, data); err == nil {
+		t.Fatal("rebuilt a group that lost more shards than it has parity")
+	}
+}
+
+func TestParseParity(t *testing.T) {
+	for _, ratio := range []string{"", "none"} {
+		if data, parity, err := parseParity(ratio); err != nil || data != 0 || parity != 0 {
+			t.Fatalf("%q: %d:%d %v", ratio, data, parity, err)
+		}
+	}
+
+	if data, parity, err := parseParity("4:1"); err != nil || data != 4 || parity != 1 {
+		t.Fatalf("4:1: %d:%d %v", data, parity, err)
+	}
+
+	for _, ratio := range []string{"4", "0:1", "4:0", "a:b", "200:100"} {
+		if _, _, err := parseParity(ratio); err == nil {
+			t.Fatalf("accepted parity %q", ratio)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	publicKeyPrefix = "dfs-pub-"
+	secretKeyPrefix = "dfs-key-"
+	recipientInfo   = "discord-fs recipient"
+	maxRecipients   = 8
+)
+
+var (
+	identity       *ecdh.PrivateKey
+	identityErr    error
+	identityLoaded bool
+	identityMu     sync.Mutex
+)
+
+func encodePublicKey(key *ecdh.PublicKey) string {
+	return publicKeyPrefix + base64.RawURLEncoding.EncodeToString(key.Bytes())
+}
+
+func parsePublicKey(s string) (*ecdh.PublicKey, error) {
+	encoded, ok := strings.CutPrefix(s, publicKeyPrefix)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a public key, expected %s followed by the key", s, publicKeyPrefix)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %q: %v", s, err)
+	}
+
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %q: %v", s, err)
+	}
+
+	return key, nil
+}
+
+// parseRecipients reads a list of public keys separated by commas. "none" or an empty list keeps a file
+// readable with your_key only.
+func parseRecipients(list string) ([]string, error) {
+	var recipients []string
+	for _, recipient := range strings.Split(list, ",") {
+		recipient = strings.TrimSpace(recipient)
+		if recipient == "" || recipient == "none" || slices.Contains(recipients, recipient) {
+			continue
+		}
+
+		if _, err := parsePublicKey(recipient); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	if len(recipients) > maxRecipients {
+		return nil, fmt.Errorf("a file can be shared with at most %d recipients, as its meta has to fit in a message", maxRecipients)
+	}
+
+	return recipients, nil
+}
+
+// applyRecipients shares a file with the holders of the given public keys. Files sent to recipients
+// don't use dedup, since the key of shared chunks would let them read the shared chunks of other files.
+func applyRecipients(f *chunkedFile, list string) error {
+	recipients, err := parseRecipients(list)
+	if err != nil {
+		return err
+	}
+
+	if f.journal != nil {
+		if !slices.Equal(recipients, f.journal.Recipients) {
+			return fmt.Errorf("recipients changed since the upload was started, resume without --recipients")
+		}
+		return nil
+	}
+
+	dedup := f.dedup
+	f.dedup = config.Bool("dedup") && len(recipients) == 0
+
+	f.sharedKey = nil
+	if f.dedup {
+		if f.sharedKey, err = loadSharedKey(); err != nil {
+			return err
+		}
+	}
+
+	kek := cachedSaltedKey(config.String("your_key"), f.salt)
+	if f.wrappedKey, err = wrapFileKey(f.key, f.sharedKey, kek, f.fileID); err != nil {
+		return err
+	}
+
+	f.recipients = recipients
+	if f.recipientKeys, err = wrapForRecipients(f.key, recipients, f.fileID); err != nil {
+		return err
+	}
+
+	// Boundaries already found were keyed for the old dedup setting.
+	if f.cuts != nil && f.dedup != dedup {
+		return f.contentDefinedChunks()
+	}
+
+	return nil
+}
+
+// recipientKey derives the key a data key is wrapped with for one recipient from the X25519 secret
+// shared by an ephemeral key and the recipient's key.
+func recipientKey(shared []byte, ephemeral []byte, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(recipientInfo)), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// wrapForRecipients wraps a data key for every recipient as a fresh ephemeral public key followed by the
+// data key sealed under a key only that recipient can derive.
+func wrapForRecipients(key []byte, recipients []string, fileID []byte) ([][]byte, error) {
+	var recipientKeys [][]byte
+	for _, recipient := range recipients {
+		public, err := parsePublicKey(recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		shared, err := ephemeral.ECDH(public)
+		if err != nil {
+			return nil, err
+		}
+
+		wrapKey, err := recipientKey(shared, ephemeral.PublicKey().Bytes(), public.Bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		wrapped, err := wrapFileKey(key, nil, wrapKey, fileID)
+		if err != nil {
+			return nil, err
+		}
+
+		recipientKeys = append(recipientKeys, append(ephemeral.PublicKey().Bytes(), wrapped...))
+	}
+
+	return recipientKeys, nil
+}
+
+// openRecipientKeys unwraps a data key with the local identity. Wrapped keys don't say who they are
+// for, so each one is tried.
+func openRecipientKeys(recipientKeys [][]byte, fileID []byte) ([]byte, error) {
+	private, err := loadIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if private == nil {
+		return nil, fmt.Errorf("no identity, run keygen to create one")
+	}
+
+	for _, wrapped := range recipientKeys {
+		if len(wrapped) < 32 {
+			continue
+		}
+
+		ephemeral, err := ecdh.X25519().NewPublicKey(wrapped[:32])
+		if err != nil {
+			continue
+		}
+
+		shared, err := private.ECDH(ephemeral)
+		if err != nil {
+			continue
+		}
+
+		wrapKey, err := recipientKey(shared, wrapped[:32], private.PublicKey().Bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		if key, _, err := openFileKey(wrapped[32:], wrapKey, fileID); err == nil {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("the file wasn't shared with this identity")
+}
+
+// loadIdentity reads the private key in the identity file once. A missing file is not an error, only
+// files shared with an identity need one.
+func loadIdentity() (*ecdh.PrivateKey, error) {
+	identityMu.Lock()
+	defer identityMu.Unlock()
+
+	if !identityLoaded {
+		identity, identityErr = readIdentity(config.String("identity"))
+		identityLoaded = true
+	}
+
+	return identity, identityErr
+}
+
+func readIdentity(file string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		encoded, ok := strings.CutPrefix(strings.TrimSpace(line), secretKeyPrefix)
+		if !ok {
+			continue
+		}
+
+		secret, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity %s: %v", file, err)
+		}
+
+		key, err := ecdh.X25519().NewPrivateKey(secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity %s: %v", file, err)
+		}
+
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("invalid identity %s: no %s line", file, secretKeyPrefix)
+}
+
+// keygen creates the identity files can be shared with and prints its public key. An existing identity
+// is only replaced with --force, since files shared with it can't be opened without it.
+func keygen(flags map[string]string) error {
+	file := config.String("identity")
+
+	existing, err := readIdentity(file)
+	if err != nil {
+		return err
+	}
+
+	if _, force := flags["force"]; existing != nil && !force {
+		logger.Printf("Identity %s already exists, replace it with keygen --force\nPublic key: %s\n", file, encodePublicKey(existing.PublicKey()))
+		return nil
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	public := encodePublicKey(key.PublicKey())
+	data := fmt.Sprintf("# created: %s\n# public key: %s\n%s%s\n", time.Now().Format(time.RFC3339), public, secretKeyPrefix, base64.RawURLEncoding.EncodeToString(key.Bytes()))
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		return fmt.Errorf("error writing identity: %v", err)
+	}
+
+	identityMu.Lock()
+	identity, identityErr, identityLoaded = key, nil, true
+	identityMu.Unlock()
+
+	logger.Printf("Wrote identity %s, keep it secret. Share the public key to receive files:\n%s\n", file, public)
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecipients(t *testing.T) {
+	dir := setupTest(t)
+	config.SetBool("dedup", true)
+
+	if err := keygen(map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	public := encodePublicKey(identity.PublicKey())
+
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := filepath.Join(dir, "shared.bin")
+	sharedData := writeRandomFile(t, shared, 12000)
+	sendTestFile(t, shared, 2, map[string]string{"recipients": encodePublicKey(other.PublicKey()) + "," + public})
+
+	private := filepath.Join(dir, "private.bin")
+	writeRandomFile(t, private, 3000)
+	sendTestFile(t, private, 1, nil)
+
+	for _, ref := range testIndex(t, "shared.bin").Chunks {
+		if ref.Address != nil {
+			t.Fatal("file sent to recipients uses shared chunks")
+		}
+	}
+
+	// The recipient doesn't know your_key, only its identity.
+	config.SetString("your_key", "recipient's own key")
+
+	entry := testEntry(t, "shared.bin")
+	if !entry.viaIdentity {
+		t.Fatal("shared file wasn't opened with the identity")
+	}
+	fetchTestFile(t, "shared.bin", sharedData)
+
+	if _, err := resolveFile("private.bin"); err == nil {
+		t.Fatal("recipient can read a file that wasn't shared with it")
+	}
+
+	// Without the identity the shared file is unreadable as well.
+	identity, identityErr, identityLoaded = nil, nil, true
+	if _, err := resolveFile("shared.bin"); err == nil {
+		t.Fatal("shared file opened without the identity")
+	}
+}
+
+func TestRecipientsKeepYourKey(t *testing.T) {
+	dir := setupTest(t)
+
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "file.bin")
+	data := writeRandomFile(t, path, 6000)
+	sendTestFile(t, path, 1, map[string]string{"recipients": encodePublicKey(other.PublicKey())})
+
+	if entry := testEntry(t, "file.bin"); entry.viaIdentity {
+		t.Fatal("sender's own file was opened with an identity")
+	}
+	fetchTestFile(t, "file.bin", data)
+}
+
+func TestParseRecipients(t *testing.T) {
+	var keys []string
+	for i := 0; i <= maxRecipients; i++ {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, encodePublicKey(key.PublicKey()))
+	}
+
+	recipients, err := parseRecipients("none")
+	if err != nil || len(recipients) != 0 {
+		t.Fatalf("none: %v %v", recipients, err)
+	}
+
+	recipients, err = parseRecipients(keys[0] + ", " + keys[1] + "," + keys[0])
+	if err != nil || len(recipients) != 2 {
+		t.Fatalf("duplicates: %v %v", recipients, err)
+	}
+
+	if _, err := parseRecipients(strings.Join(keys, ",")); err == nil {
+		t.Fatalf("accepted %d recipients", len(keys))
+	}
+
+	if _, err := parseRecipients("dfs-pub-notakey"); err == nil {
+		t.Fatal("accepted an invalid public key")
+	}
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sendChunkedFile uploads a file and posts its manifest entry, returning the entry's message ID.
+func sendChunkedFile(f *chunkedFile, workers int) (reference string, err error) {
+	dataChannels := backend.DataChannels()
+
+	if len(dataChannels) == 0 {
+		return "", fmt.Errorf("no data channels, run init first")
+	}
+
+	metaString, err := generateMeta(&fileMeta{
+		Name:          f.name,
+		Size:          f.size,
+		Chunks:        f.chunks,
+		Mode:          uint32(f.mode),
+		ModTime:       f.modTime.UnixNano(),
+		Compression:   f.compression,
+		salt:          f.salt,
+		fileID:        f.fileID,
+		wrappedKey:    f.wrappedKey,
+		recipientKeys: f.recipientKeys,
+	}, f.key)
+	if err != nil {
+		return "", fmt.Errorf("error encrypting metadata: %v", err)
+	}
+
+	if err := checkManifestEntry(metaString); err != nil {
+		return "", err
+	}
+
+	if f.journal == nil {
+		if previous, err := loadJournal(f.path); err == nil {
+			logger.Printf("Starting %s over, abandoning %d chunks of its unfinished upload\n", f.name, previous.confirmed())
+		}
+		if f.journal, err = newJournal(f.path, f, workers > 1 || f.dedup || f.parityData > 0); err != nil {
+			return "", fmt.Errorf("error creating upload journal: %v", err)
+		}
+	} else {
+		logger.Printf("Resuming %s, %d/%d chunks already uploaded\n", f.name, f.journal.confirmed(), f.chunks)
+		if !f.journal.Parallel && workers > 1 {
+			logger.Printf("%s was started as a chained upload, resuming with a single worker\n", f.name)
+		}
+	}
+
+	if f.dedup {
+		if _, err := loadChunkIndex(); err != nil {
+			return "", fmt.Errorf("error loading chunk index: %v", err)
+		}
+	}
+
+	lastMessageID := ""
+	if f.journal.Parallel {
+		err = uploadParallel(f, metaString, dataChannels, workers)
+	} else {
+		lastMessageID, err = uploadChain(f, metaString, dataChannels)
+	}
+
+	logger.RemoveLine(fmt.Sprintf("send_%s", f.name))
+
+	if f.dedup {
+		if err := sharedChunks.save(); err != nil {
+			logger.Printf("Error saving chunk index: %v\n", err)
+		}
+		if f.reused > 0 {
+			logger.Printf("%s: reused %d/%d chunks already on Discord\n", f.name, f.reused, f.chunks)
+		}
+	}
+
+	if err != nil {
+		logger.Printf("Aborting send of %s. %d/%d chunks were uploaded, run \"send %s --resume\" to continue\n", f.name, f.journal.confirmed(), f.chunks, f.path)
+		return "", err
+	}
+
+	logger.Printf("%s: sending attachment %d (size %d); %s\n", f.name, f.chunks, f.size, ProgressBarUtil(1, 1))
+
+	sealedIndex, err := sealIndex(&fileIndex{
+		Chunks:       f.journal.Chunks,
+		Hash:         f.fileHash.Sum(nil),
+		ParityData:   f.journal.ParityData,
+		ParityShards: f.journal.ParityShards,
+		Parity:       f.journal.Parity,
+	}, f.key, f.fileID)
+	if err != nil {
+		return "", fmt.Errorf("error encrypting index: %v", err)
+	}
+
+	reference, err = backend.PutManifest(messageCreate{
+		Content:  formatManifestEntry(metaString, lastMessageID),
+		Data:     sealedIndex,
+		FileName: indexFileName,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error sending manifest, run \"send %s --resume\" to retry: %v", f.path, err)
+	}
+
+	f.journal.remove()
+
+	logger.Printf("Sent file %s, reference %s\n", f.name, reference)
+
+	rememberName(f.name)
+
+	idHistory = append(idHistory, reference)
+
+	return reference, nil
+}
+
+// uploadChain sends chunks one at a time, each replying to the previous one, and returns the ID of the
+// last message. This keeps uploads readable by walking the chain even without the manifest index.
+func uploadChain(f *chunkedFile, metaString string, dataChannels []string) (string, error) {
+	lastMessageID := ""
+	for n := 0; n < f.chunks; n++ {
+		if ref := f.journal.Chunks[n]; ref.Message != "" {
+			if err := f.skipChunk(ref.Hash); err != nil {
+				return "", err
+			}
+			lastMessageID = ref.Message
+			continue
+		}
+
+		job, err := f.nextChunk()
+		if err == io.EOF {
+			return "", fmt.Errorf("file %s ended early at chunk %d of %d", f.name, n, f.chunks)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		message := messageCreate{
+			ChannelID:   dataChannels[n%len(dataChannels)],
+			ReferenceID: lastMessageID,
+			Data:        job.data,
+			FileName:    fmt.Sprintf("%d.enc", n),
+		}
+
+		if n == 0 {
+			message.Content = metaString
+		}
+
+		logger.AddLine(
+			fmt.Sprintf("send_%s", f.name),
+			fmt.Sprintf("%s: sending attachment %d (size %d); %s", f.name, n+1, f.size, ProgressBarUtil(n+1, f.chunks)),
+		)
+
+		lastMessageID, err = backend.PutChunk(message)
+		if err != nil {
+			logger.Printf("Error sending chunk %d: %v\n", n, err)
+			return "", err
+		}
+
+		if err := f.journal.record(n, chunkRef{Channel: message.ChannelID, Message: lastMessageID, Size: len(job.data), Hash: job.hash, Length: job.length}); err != nil {
+			return "", fmt.Errorf("error writing upload journal: %v", err)
+		}
+	}
+
+	return lastMessageID, nil
+}
+
+type uploadJob struct {
+	n       int
+	data    []byte
+	hash    []byte
+	address []byte
+	length  int64
+}
+
+// uploadParallel sends chunks concurrently without reply links; their order is only recorded in the
+// index. At most workers chunks are read ahead, so memory stays bounded.
+func uploadParallel(f *chunkedFile, metaString string, dataChannels []string, workers int) error {
+	jobs := make(chan uploadJob)
+	failed := make(chan struct{})
+
+	var parity *parityEncoder
+	if f.parityData > 0 {
+		parity = newParityEncoder(f, dataChannels)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sent     = f.journal.confirmed()
+	)
+
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if firstErr == nil {
+			firstErr = err
+			close(failed)
+		}
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for job := range jobs {
+				var ref chunkRef
+				reused := false
+				if job.address != nil {
+					ref, reused = sharedChunks.reuse(job.address)
+				}
+
+				if !reused {
+					message := messageCreate{
+						ChannelID: dataChannels[job.n%len(dataChannels)],
+						Data:      job.data,
+						FileName:  fmt.Sprintf("%d.enc", job.n),
+					}
+
+					if job.n == 0 {
+						message.Content = metaString
+					}
+
+					messageID, err := backend.PutChunk(message)
+					if err != nil {
+						logger.Printf("Error sending chunk %d: %v\n", job.n, err)
+						fail(err)
+						continue
+					}
+
+					ref = chunkRef{Channel: message.ChannelID, Message: messageID, Size: len(job.data)}
+					if job.address != nil {
+						sharedChunks.add(job.address, ref)
+					}
+				}
+
+				ref.Hash = job.hash
+				ref.Address = job.address
+				ref.Length = job.length
+
+				if err := f.journal.record(job.n, ref); err != nil {
+					fail(fmt.Errorf("error writing upload journal: %v", err))
+					continue
+				}
+
+				if parity != nil {
+					// A reused chunk was sealed with another nonce, parity has to cover the stored one.
+					data := job.data
+					var err error
+					if reused {
+						data, err = storedChunk(ref)
+					}
+					if err == nil {
+						err = parity.add(job.n, data)
+					}
+					if err != nil {
+						logger.Printf("Error sending parity of chunk %d: %v\n", job.n, err)
+						fail(err)
+						continue
+					}
+				}
+
+				mu.Lock()
+				if reused {
+					f.reused++
+				}
+				sent++
+				logger.AddLine(
+					fmt.Sprintf("send_%s", f.name),
+					fmt.Sprintf("%s: sent %d/%d attachments with %d workers (size %d); %s", f.name, sent, f.chunks, workers, f.size, ProgressBarUtil(sent, f.chunks)),
+				)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var readErr error
+read:
+	for n := 0; n < f.chunks; n++ {
+		if ref := f.journal.Chunks[n]; ref.Message != "" {
+			if readErr = f.skipChunk(ref.Hash); readErr != nil {
+				break
+			}
+
+			if parity != nil && !f.journal.parityDone(n/f.parityData) {
+				var data []byte
+				if data, readErr = storedChunk(ref); readErr != nil {
+					readErr = fmt.Errorf("error downloading chunk %d to rebuild its parity: %v", n, readErr)
+					break
+				}
+				if readErr = parity.add(n, data); readErr != nil {
+					break
+				}
+			}
+			continue
+		}
+
+		job, err := f.nextChunk()
+		if err == io.EOF {
+			readErr = fmt.Errorf("file %s ended early at chunk %d of %d", f.name, n, f.chunks)
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+
+		select {
+		case jobs <- job:
+		case <-failed:
+			break read
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	if readErr != nil {
+		return readErr
+	}
+
+	return firstErr
+}
+
+// findDataMessage looks a message up in the channel it most likely lives in first, then probes every
+// other data channel. Chains sent before chunk channels were recorded can span all of them.
+func findDataMessage(messageID string, hint string) (*discordMessage, error) {
+	channels := make([]string, 0, len(backend.DataChannels())+1)
+	if hint != "" {
+		channels = append(channels, hint)
+	}
+	for _, channelID := range backend.DataChannels() {
+		if channelID != hint {
+			channels = append(channels, channelID)
+		}
+	}
+
+	for _, channelID := range channels {
+		message, err := backend.GetMessage(channelID, messageID)
+		if err == nil {
+			if message.ChannelID == "" {
+				message.ChannelID = channelID
+			}
+			return message, nil
+		}
+
+		if !errors.Is(err, errNotFound) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("message %s in any data channel: %w", messageID, errNotFound)
+}
+
+// previousDataChannel predicts where the previous chunk of a chain was sent, since chunk n goes to
+// data channel n modulo the number of data channels.
+func previousDataChannel(channelID string) string {
+	dataChannels := backend.DataChannels()
+	for i, c := range dataChannels {
+		if c == channelID {
+			return dataChannels[(i-1+len(dataChannels))%len(dataChannels)]
+		}
+	}
+	return ""
+}
+
+func fetchChunkedFile(chainEndId string) (cf *chunkedFile, err error) {
+	cf = &chunkedFile{}
+	dataChannels := backend.DataChannels()
+
+	if len(dataChannels) == 0 {
+		return nil, fmt.Errorf("no data channels, run init first")
+	}
+
+	logger.Printf("Resolving chain for reference %s\n", chainEndId)
+
+	lastMessage, err := findDataMessage(chainEndId, "")
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		cf.messages = append(cf.messages, lastMessage)
+
+		logger.AddLine(
+			fmt.Sprintf("resolve_%s", chainEndId),
+			fmt.Sprintf("%s: resolved %d messages", chainEndId, len(cf.messages)),
+		)
+
+		if lastMessage.Reference.MessageID == "" {
+			break
+		}
+
+		hint := lastMessage.Reference.ChannelID
+		if hint == "" {
+			hint = previousDataChannel(lastMessage.ChannelID)
+		}
+
+		lastMessage, err = findDataMessage(lastMessage.Reference.MessageID, hint)
+		if err != nil {
+			logger.RemoveLine(fmt.Sprintf("resolve_%s", chainEndId))
+			return nil, err
+		}
+	}
+
+	logger.RemoveLine(fmt.Sprintf("resolve_%s", chainEndId))
+
+	for i := len(cf.messages)/2 - 1; i >= 0; i-- {
+		opp := len(cf.messages) - 1 - i
+		cf.messages[i], cf.messages[opp] = cf.messages[opp], cf.messages[i]
+	}
+
+	meta, err := parseMeta(lastMessage.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	cf.name, cf.salt, cf.fileID, cf.size = meta.Name, meta.salt, meta.fileID, meta.Size
+	cf.key, cf.sharedKey = meta.key, meta.sharedKey
+	cf.chunks = len(cf.messages)
+	cf.mode = os.FileMode(meta.Mode)
+	cf.compression = meta.Compression
+	if meta.ModTime != 0 {
+		cf.modTime = time.Unix(0, meta.ModTime)
+	}
+
+	logger.Printf("Resolved file %s out of %d chunks\n", cf.name, cf.chunks)
+
+	return cf, nil
+}
+
+func fetchIndexedFile(entry *manifestEntry) (cf *chunkedFile, err error) {
+	cf = &chunkedFile{
+		name:        entry.name,
+		salt:        entry.salt,
+		fileID:      entry.fileID,
+		key:         entry.key,
+		sharedKey:   entry.sharedKey,
+		size:        entry.size,
+		mode:        entry.mode,
+		modTime:     entry.modTime,
+		compression: entry.compression,
+	}
+
+	index, err := readFileIndex(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Printf("Resolving %d chunks for %s\n", len(index.Chunks), entry.name)
+
+	cf.wantHash = index.Hash
+	cf.parityData, cf.parityShards, cf.parityRefs = index.ParityData, index.ParityShards, index.Parity
+
+	for n, ref := range index.Chunks {
+		cf.hashes = append(cf.hashes, ref.Hash)
+		cf.addresses = append(cf.addresses, ref.Address)
+		cf.lengths = append(cf.lengths, ref.Length)
+		cf.sizes = append(cf.sizes, ref.Size)
+
+		message, err := backend.GetMessage(ref.Channel, ref.Message)
+		if errors.Is(err, errNotFound) {
+			message, err = findDataMessage(ref.Message, "")
+		}
+		if errors.Is(err, errNotFound) && cf.parityData > 0 {
+			logger.Printf("Chunk %d of %s is missing, it will be rebuilt from parity\n", n, entry.name)
+			message, err = nil, nil
+		}
+		if err != nil {
+			logger.RemoveLine(fmt.Sprintf("resolve_%s", entry.messageID))
+			return nil, fmt.Errorf("error resolving chunk %d: %w", n, err)
+		}
+
+		cf.messages = append(cf.messages, message)
+
+		logger.AddLine(
+			fmt.Sprintf("resolve_%s", entry.messageID),
+			fmt.Sprintf("%s: resolved %d/%d messages; %s", entry.name, n+1, len(index.Chunks), ProgressBarUtil(n+1, len(index.Chunks))),
+		)
+	}
+
+	logger.RemoveLine(fmt.Sprintf("resolve_%s", entry.messageID))
+
+	cf.chunks = len(cf.messages)
+
+	return cf, nil
+}
+
+func fetchEntry(entry *manifestEntry) (*chunkedFile, error) {
+	if entry.index != nil {
+		return fetchIndexedFile(entry)
+	}
+
+	if entry.reference == "" {
+		return nil, fmt.Errorf("manifest entry %s has neither an index nor a chain reference", entry.messageID)
+	}
+
+	return fetchChunkedFile(entry.reference)
+}
+
+type fetchOptions struct {
+	workers int
+	resume  bool
+	force   bool
+	dec     bool
+	output  string
+}
+
+// outputPath is where a file or directory is written: the path it was sent from, unless --output
+// overrides it. Versions fetched with --all get an @N suffix, and --dec appends .dec to keep clear of
+// the original.
+func outputPath(name string, version int, options fetchOptions) string {
+	path := options.output
+	if path == "" {
+		path = filepath.FromSlash(normalizePath(filepath.FromSlash(name)))
+	}
+	if version > 0 {
+		path = fmt.Sprintf("%s@%d", path, version)
+	}
+	if options.dec {
+		path += ".dec"
+	}
+	return path
+}
+
+func reconstructTo(cf *chunkedFile, version int, options fetchOptions) error {
+	logger.Printf("Decrypting and reconstructing file %s\n", cf.name)
+
+	return reconstructFile(cf, outputPath(cf.name, version, options), options)
+}
+
+// fetchFile fetches by chain-end reference or by file name. Names resolve to the newest version
+// unless a version is picked with name@N (1 being the newest) or every version is fetched with --all.
+func fetchFile(query string, flags map[string]string) error {
+	workers, err := workerCount(flags, "download_workers")
+	if err != nil {
+		return err
+	}
+
+	_, resume := flags["resume"]
+	_, force := flags["force"]
+	_, dec := flags["dec"]
+	options := fetchOptions{workers: workers, resume: resume, force: force, dec: dec, output: flags["output"]}
+
+	return fetchQuery(query, flags, options)
+}
+
+// fetchQuery resolves a query on the active backend. Queries that can't be resolved on the primary are
+// retried on the other replicas.
+func fetchQuery(query string, flags map[string]string, options fetchOptions) error {
+	if isSnowflake(query) {
+		message, err := backend.GetMessage(backend.ManifestChannel(), query)
+		if err == nil {
+			entry, err := parseManifestEntry(message)
+			if err != nil {
+				return err
+			}
+			return fetchEntryTo(entry, 0, options)
+		}
+		if !errors.Is(err, errNotFound) {
+			return fetchQueryFromReplicas(query, flags, options, fmt.Errorf("error fetching file: %v", err))
+		}
+
+		cf, err := fetchChunkedFile(query)
+		if err == nil {
+			return reconstructTo(cf, 0, options)
+		}
+		if !errors.Is(err, errNotFound) {
+			return fmt.Errorf("error fetching file: %v", err)
+		}
+	}
+
+	name, version := splitVersion(query)
+
+	versions, err := resolveFile(name)
+	if err != nil {
+		return fetchQueryFromReplicas(query, flags, options, err)
+	}
+
+	if _, all := flags["all"]; all {
+		for n, entry := range versions {
+			logger.Printf("Fetching %s@%d uploaded %s\n", entry.name, n+1, entry.uploaded.Local().Format("2006-01-02 15:04"))
+			if err := fetchEntryTo(entry, n+1, options); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	entry, err := pickVersion(name, versions, version, "fetching")
+	if err != nil {
+		return err
+	}
+
+	return fetchEntryTo(entry, 0, options)
+}
+
+// fetchEntryTo fetches an entry, falling back to its copies on other replicas when that fails.
+func fetchEntryTo(entry *manifestEntry, version int, options fetchOptions) error {
+	var err error
+	if entry.dir {
+		err = fetchDirectory(entry, version, options)
+	} else {
+		var cf *chunkedFile
+		if cf, err = fetchEntry(entry); err != nil {
+			err = fmt.Errorf("error fetching file: %v", err)
+		} else {
+			err = reconstructTo(cf, version, options)
+		}
+	}
+
+	if err != nil {
+		return fetchFromReplicas(entry, version, options, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type verifyReport struct {
+	name     string
+	checked  int
+	problems []string
+	mu       sync.Mutex
+}
+
+func (r *verifyReport) problem(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	problem := fmt.Sprintf(format, args...)
+	r.problems = append(r.problems, problem)
+	logger.Printf("  %s: %s\n", r.name, problem)
+}
+
+// verifyIndex checks every chunk recorded in the index still has its message and an attachment of
+// the recorded size. Missing chunks are left nil in the returned file.
+func verifyIndex(entry *manifestEntry, report *verifyReport) (*chunkedFile, error) {
+	cf := &chunkedFile{name: entry.name, salt: entry.salt, fileID: entry.fileID, key: entry.key, sharedKey: entry.sharedKey, compression: entry.compression}
+
+	key := entry.key
+
+	sealedIndex, err := backend.GetChunk(*entry.index)
+	if errors.Is(err, errNotFound) {
+		report.problem("index attachment of manifest message %s was deleted", entry.messageID)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error downloading index: %v", err)
+	}
+
+	index, err := openIndex(sealedIndex, key, entry.fileID)
+	if err != nil {
+		report.problem("index of manifest message %s is corrupt: %v", entry.messageID, err)
+		return nil, nil
+	}
+
+	cf.wantHash = index.Hash
+	cf.chunks = len(index.Chunks)
+
+	for n, ref := range index.Chunks {
+		cf.hashes = append(cf.hashes, ref.Hash)
+		cf.addresses = append(cf.addresses, ref.Address)
+		cf.lengths = append(cf.lengths, ref.Length)
+
+		logger.AddLine(
+			fmt.Sprintf("verify_%s", entry.messageID),
+			fmt.Sprintf("%s: checked %d/%d messages; %s", entry.name, n+1, len(index.Chunks), ProgressBarUtil(n+1, len(index.Chunks))),
+		)
+
+		message, err := backend.GetMessage(ref.Channel, ref.Message)
+		if errors.Is(err, errNotFound) {
+			message, err = findDataMessage(ref.Message, "")
+		}
+		if errors.Is(err, errNotFound) {
+			report.problem("chunk %d: message %s in channel %s is missing", n, ref.Message, ref.Channel)
+			cf.messages = append(cf.messages, nil)
+			continue
+		}
+		if err != nil {
+			logger.RemoveLine(fmt.Sprintf("verify_%s", entry.messageID))
+			return nil, err
+		}
+
+		report.checked++
+
+		if len(message.Attachments) == 0 {
+			report.problem("chunk %d: attachment of message %s was deleted", n, ref.Message)
+			cf.messages = append(cf.messages, nil)
+			continue
+		}
+
+		if ref.Size != 0 && message.Attachments[0].Size != ref.Size {
+			report.problem("chunk %d: attachment is %d bytes, expected %d", n, message.Attachments[0].Size, ref.Size)
+		}
+
+		cf.messages = append(cf.messages, message)
+	}
+
+	logger.RemoveLine(fmt.Sprintf("verify_%s", entry.messageID))
+
+	if index.ParityData > 0 {
+		if err := verifyParity(index, cf, report); err != nil {
+			return nil, err
+		}
+	}
+
+	return cf, nil
+}
+
+// verifyParity checks the parity chunks of every group and whether the chunks a group lost can still
+// be rebuilt from them.
+func verifyParity(index *fileIndex, cf *chunkedFile, report *verifyReport) error {
+	k, m := index.ParityData, index.ParityShards
+
+	for g := 0; g*k < len(index.Chunks); g++ {
+		lost := 0
+		for n := g * k; n < (g+1)*k && n < len(index.Chunks); n++ {
+			if cf.messages[n] == nil {
+				lost++
+			}
+		}
+
+		damaged := lost
+		for i := 0; i < m; i++ {
+			ref := index.Parity[g*m+i]
+
+			message, err := backend.GetMessage(ref.Channel, ref.Message)
+			if errors.Is(err, errNotFound) {
+				report.problem("parity chunk %d: message %s in channel %s is missing", g*m+i, ref.Message, ref.Channel)
+				damaged++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			report.checked++
+
+			if len(message.Attachments) == 0 || message.Attachments[0].Size != ref.Size {
+				report.problem("parity chunk %d: attachment of message %s was deleted or changed", g*m+i, ref.Message)
+				damaged++
+			}
+		}
+
+		if damaged > m {
+			report.problem("group %d lost %d chunks, more than its %d parity chunks can rebuild", g, damaged, m)
+		} else if lost > 0 {
+			logger.Printf("  %s: group %d can still be rebuilt from parity\n", report.name, g)
+		}
+	}
+
+	return nil
+}
+
+// verifyChain walks a reply chain for uploads without an index. A missing message breaks the chain,
+// so everything before it can't be reached and isn't checked.
+func verifyChain(chainEnd string, entry *manifestEntry, report *verifyReport) (*chunkedFile, error) {
+	cf := &chunkedFile{name: report.name}
+
+	message, err := findDataMessage(chainEnd, "")
+	if errors.Is(err, errNotFound) {
+		report.problem("last message %s of the chain is missing", chainEnd)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		report.checked++
+		cf.messages = append(cf.messages, message)
+
+		logger.AddLine(
+			fmt.Sprintf("verify_%s", chainEnd),
+			fmt.Sprintf("%s: checked %d messages", report.name, len(cf.messages)),
+		)
+
+		if len(message.Attachments) == 0 {
+			report.problem("attachment of message %s was deleted", message.ID)
+		}
+
+		if message.Reference.MessageID == "" {
+			break
+		}
+
+		hint := message.Reference.ChannelID
+		if hint == "" {
+			hint = previousDataChannel(message.ChannelID)
+		}
+
+		previous, err := findDataMessage(message.Reference.MessageID, hint)
+		if errors.Is(err, errNotFound) {
+			report.problem("chain is broken: message %s referenced by %s is missing", message.Reference.MessageID, message.ID)
+			logger.RemoveLine(fmt.Sprintf("verify_%s", chainEnd))
+			return nil, nil
+		}
+		if err != nil {
+			logger.RemoveLine(fmt.Sprintf("verify_%s", chainEnd))
+			return nil, err
+		}
+
+		message = previous
+	}
+
+	logger.RemoveLine(fmt.Sprintf("verify_%s", chainEnd))
+
+	for i, j := 0, len(cf.messages)-1; i < j; i, j = i+1, j-1 {
+		cf.messages[i], cf.messages[j] = cf.messages[j], cf.messages[i]
+	}
+
+	cf.chunks = len(cf.messages)
+	if meta, err := parseMeta(message.Content); err == nil {
+		cf.name, cf.salt, cf.fileID, cf.compression = meta.Name, meta.salt, meta.fileID, meta.Compression
+		cf.key, cf.sharedKey = meta.key, meta.sharedKey
+	} else if entry != nil {
+		cf.name, cf.salt, cf.fileID, cf.compression = entry.name, entry.salt, entry.fileID, entry.compression
+		cf.key, cf.sharedKey = entry.key, entry.sharedKey
+	} else {
+		report.problem("metadata of message %s is unreadable: %v", message.ID, err)
+	}
+
+	if entry != nil && entry.chunks >= 0 && entry.chunks != cf.chunks {
+		report.problem("chain has %d chunks, the manifest recorded %d", cf.chunks, entry.chunks)
+	}
+
+	for n, m := range cf.messages {
+		if len(m.Attachments) == 0 {
+			cf.messages[n] = nil
+			continue
+		}
+		if number, err := strconv.Atoi(strings.TrimSuffix(m.Attachments[0].Filename, ".enc")); err == nil && number != n {
+			report.problem("message %s holds chunk %d where chunk %d was expected", m.ID, number, n)
+		}
+	}
+
+	return cf, nil
+}
+
+// verifyDeep downloads and authenticates every reachable chunk against its recorded hash, discarding
+// the plaintext.
+func verifyDeep(cf *chunkedFile, report *verifyReport, workers int) {
+	if cf.salt == nil {
+		return
+	}
+
+	if cf.fileID == nil {
+		logger.Printf("%s predates authenticated chunks, a deep check only confirms the chunks download\n", cf.name)
+	}
+
+	key := cf.key
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := 0
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for n := range jobs {
+				if _, err := cf.downloadChunk(key, n); err != nil {
+					report.problem("chunk %d: %v", n, err)
+				}
+
+				mu.Lock()
+				done++
+				logger.AddLine(
+					fmt.Sprintf("verify_deep_%s", cf.name),
+					fmt.Sprintf("%s: authenticated %d/%d chunks; %s", cf.name, done, len(cf.messages), ProgressBarUtil(done, len(cf.messages))),
+				)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for n, message := range cf.messages {
+		if message != nil {
+			jobs <- n
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	logger.RemoveLine(fmt.Sprintf("verify_deep_%s", cf.name))
+}
+
+// verifyEntry audits one file, reporting problems as they are found.
+func verifyEntry(entry *manifestEntry, chainEnd string, name string, deep bool, workers int) (*verifyReport, error) {
+	report := &verifyReport{name: name}
+
+	logger.Printf("Verifying %s\n", name)
+
+	var cf *chunkedFile
+	var err error
+	if entry != nil && entry.index != nil {
+		cf, err = verifyIndex(entry, report)
+	} else if chainEnd != "" {
+		cf, err = verifyChain(chainEnd, entry, report)
+	} else {
+		report.problem("manifest entry %s has neither an index nor a chain reference", entry.messageID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if deep && cf != nil {
+		verifyDeep(cf, report, workers)
+	}
+
+	return report, nil
+}
+
+func verifyDirectory(entry *manifestEntry, deep bool, workers int) error {
+	index, err := openDirIndex(entry)
+	if err != nil {
+		return fmt.Errorf("error reading directory %s: %v", entry.name, err)
+	}
+
+	files, checked, problems := 0, 0, 0
+	for _, member := range index.Entries {
+		if member.Dir {
+			continue
+		}
+
+		files++
+
+		fileEntry, err := memberEntry(member)
+		if errors.Is(err, errNotFound) {
+			logger.Printf("  %s: manifest entry %s is missing\n", member.Path, member.Reference)
+			problems++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading manifest entry of %s: %v", member.Path, err)
+		}
+
+		report, err := verifyEntry(fileEntry, fileEntry.reference, fileEntry.name, deep, workers)
+		if err != nil {
+			return err
+		}
+
+		checked += report.checked
+		problems += len(report.problems)
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("directory %s failed verification with %d problems", entry.name, problems)
+	}
+
+	logger.Printf("%s is intact, %d files and %d messages checked\n", entry.name, files, checked)
+
+	return nil
+}
+
+func verifyFile(query string, flags map[string]string) error {
+	workers, err := workerCount(flags, "download_workers")
+	if err != nil {
+		return err
+	}
+
+	entry, chainEnd, err := findEntry(query, "verifying")
+	if err != nil {
+		return err
+	}
+
+	_, deep := flags["deep"]
+
+	if entry != nil && entry.dir {
+		return verifyDirectory(entry, deep, workers)
+	}
+
+	name := query
+	if entry != nil {
+		name = entry.name
+		chainEnd = entry.reference
+	}
+
+	report, err := verifyEntry(entry, chainEnd, name, deep, workers)
+	if err != nil {
+		return err
+	}
+
+	if len(report.problems) > 0 {
+		return fmt.Errorf("%s failed verification with %d problems", report.name, len(report.problems))
+	}
+
+	logger.Printf("%s is intact, %d messages checked\n", report.name, report.checked)
+
+	return nil
+}
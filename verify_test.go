@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func verifyProblems(t *testing.T, name string, deep bool) []string {
+	t.Helper()
+
+	entry := testEntry(t, name)
+	report, err := verifyEntry(entry, entry.reference, entry.name, deep, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return report.problems
+}
+
+func TestVerifyDeep(t *testing.T) {
+	dir := setupTest(t)
+	config.SetInt("max_retry", 1)
+
+	path := filepath.Join(dir, "file.bin")
+	writeRandomFile(t, path, 20000)
+	sendTestFile(t, path, 2, nil)
+
+	if err := verifyFile("file.bin", map[string]string{"deep": ""}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupted chunk keeps its size, so only a deep check finds it.
+	index := testIndex(t, "file.bin")
+	attachment := attachmentPath(t, index.Chunks[1])
+	data, err := os.ReadFile(attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 1
+	if err := os.WriteFile(attachment, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems := verifyProblems(t, "file.bin", false); len(problems) != 0 {
+		t.Fatalf("shallow check found %v", problems)
+	}
+	if problems := verifyProblems(t, "file.bin", true); len(problems) != 1 || !strings.HasPrefix(problems[0], "chunk 1:") {
+		t.Fatalf("deep check found %v", problems)
+	}
+
+	// A deleted message is found either way, and isn't downloaded by a deep check.
+	ref := index.Chunks[3]
+	if err := backend.Delete(ref.Channel, []string{ref.Message}); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems := verifyProblems(t, "file.bin", false); len(problems) != 1 || !strings.Contains(problems[0], "chunk 3: message "+ref.Message) {
+		t.Fatalf("shallow check found %v", problems)
+	}
+	problems := verifyProblems(t, "file.bin", true)
+	if len(problems) != 2 || !strings.HasPrefix(problems[0], "chunk 3:") || !strings.HasPrefix(problems[1], "chunk 1:") {
+		t.Fatalf("deep check found %v", problems)
+	}
+
+	if err := verifyFile("file.bin", map[string]string{"deep": ""}); err == nil {
+		t.Fatal("damaged file passed verification")
+	}
+}